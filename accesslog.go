@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ACCESS_LOG_LEVEL_INFO    = "info"
+	ACCESS_LOG_LEVEL_WARNING = "warning"
+	ACCESS_LOG_LEVEL_ERROR   = "error"
+)
+
+/*
+Wraps a ResponseWriter to record the status and size of the response for the access log. Flushing and
+hijacking are passed through, so streaming and WebSocket routes work as they do unwrapped.
+*/
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(n)
+
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("The response doesn't support hijacking")
+	}
+	w.status = http.StatusSwitchingProtocols
+
+	return hijacker.Hijack()
+}
+
+/*
+Wrap a handler to write a line to the service log for every request it handles, when `access_log` is on.
+Unlike the audit log, this covers every route, including health checks and requests that fail authentication.
+*/
+func accessLogHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !getConfig().AccessLog {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		started := time.Now()
+		logWriter := &accessLogWriter{ResponseWriter: w}
+
+		handler.ServeHTTP(logWriter, r)
+
+		// A handler that writes nothing gets an empty 200
+		status := logWriter.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		writeAccessLog(fmt.Sprintf("method=%s path=%q status=%d duration_ms=%d bytes=%d ip=%s",
+			r.Method, r.URL.Path, status, time.Since(started).Milliseconds(), logWriter.bytes, clientIP(r)))
+	})
+}
+
+/*
+Write an access log line at the configured level, which defaults to info
+*/
+func writeAccessLog(line string) {
+	switch strings.ToLower(getConfig().AccessLogLevel) {
+	case ACCESS_LOG_LEVEL_WARNING:
+		svcLogger.Warning(line)
+	case ACCESS_LOG_LEVEL_ERROR:
+		svcLogger.Error(line)
+	default:
+		svcLogger.Info(line)
+	}
+}
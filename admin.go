@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	REDACTED = "****"
+)
+
+var (
+	// Config fields that can be changed at runtime through /admin/config, by JSON name.
+	// Anything else is read once at startup, so needs a restart to change.
+	mutableConfigFields = map[string]bool{
+		"key":                              true,
+		"access_log":                       true,
+		"access_log_level":                 true,
+		"pretty_responses":                 true,
+		"raw_responses":                    true,
+		"field_case":                       true,
+		"time_format":                      true,
+		"decimal_format":                   true,
+		"auth_failure_limit":               true,
+		"auth_failure_window_seconds":      true,
+		"auth_lockout_seconds":             true,
+		"max_connections_per_ip":           true,
+		"circuit_breaker_failures":         true,
+		"circuit_breaker_cooldown_seconds": true,
+		"trusted_proxies":                  true,
+		"allowed_origins":                  true,
+		"enabled_task_types":               true,
+		"task_schemas":                     true,
+		"databases":                        true,
+		"dsn_vars":                         true,
+		"default_db_type":                  true,
+		"db_conn_max_lifetime_seconds":     true,
+		"slow_query_ms":                    true,
+		"redact_verbose_logs":              true,
+		"max_response_bytes":               true,
+		"max_columns":                      true,
+		"idempotency_ttl_seconds":          true,
+		"maintenance_retry_after_seconds":  true,
+	}
+
+	configUpdateLock sync.Mutex // Serialises config updates, so concurrent PATCHes don't lose each other's changes
+)
+
+/*
+Copy the running config with secrets replaced, including every `dsn_vars` value, so it is safe to return to
+support staff or write to the service log
+*/
+func redactedConfig() ConnectorConfig {
+	running := getConfig()
+	redacted := *running
+	if redacted.ApiKey != "" {
+		redacted.ApiKey = REDACTED
+	}
+
+	redacted.DsnVars = redactedDsnVars(running.DsnVars)
+
+	if len(running.Databases) > 0 {
+		redacted.Databases = make(map[string]TaskDbConfig, len(running.Databases))
+		for name, dbConfig := range running.Databases {
+			redacted.Databases[name] = redactedDbConfig(dbConfig)
+		}
+	}
+
+	return redacted
+}
+
+/*
+Print the config the connector would run with, after flags and the environment overlay are applied, with
+secrets redacted, so support staff can check which setting won
+*/
+func printEffectiveConfig() error {
+	data, err := json.MarshalIndent(redactedConfig(), "", "    ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(data))
+
+	return nil
+}
+
+/*
+Copy a database config with its DSNs and SSH password replaced, as DSNs usually hold credentials
+*/
+func redactedDbConfig(dbConfig TaskDbConfig) TaskDbConfig {
+	if dbConfig.Dsn != "" {
+		dbConfig.Dsn = REDACTED
+	}
+	if len(dbConfig.Dsns) > 0 {
+		dsns := make([]string, len(dbConfig.Dsns))
+		for i := range dsns {
+			dsns[i] = REDACTED
+		}
+		dbConfig.Dsns = dsns
+	}
+	if dbConfig.SshTunnel != nil && dbConfig.SshTunnel.Password != "" {
+		tunnel := *dbConfig.SshTunnel
+		tunnel.Password = REDACTED
+		dbConfig.SshTunnel = &tunnel
+	}
+	dbConfig.DsnVars = redactedDsnVars(dbConfig.DsnVars)
+	if dbConfig.AzureAuth != nil && dbConfig.AzureAuth.ClientSecret != "" {
+		azureAuth := *dbConfig.AzureAuth
+		azureAuth.ClientSecret = REDACTED
+		dbConfig.AzureAuth = &azureAuth
+	}
+
+	return dbConfig
+}
+
+/*
+Redact every DSN placeholder value, as any of them may be a credential
+*/
+func redactedDsnVars(dsnVars map[string]string) map[string]string {
+	if len(dsnVars) == 0 {
+		return dsnVars
+	}
+
+	redacted := make(map[string]string, len(dsnVars))
+	for name := range dsnVars {
+		redacted[name] = REDACTED
+	}
+
+	return redacted
+}
+
+/*
+Handle an HTTP request to the /admin/config URL - display the running config with secrets redacted
+*/
+func handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		if err := updateConfig(r); err != nil {
+			status, response := newErrorResponse(err)
+			writeResponse(w, r, status, response)
+			return
+		}
+	default:
+		writeResponse(w, r, http.StatusMethodNotAllowed, JsonResponse{
+			Type: "error",
+			Body: "Config must be read with GET or updated with PATCH",
+		})
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, JsonResponse{
+		Type: "success",
+		Body: redactedConfig(),
+	})
+}
+
+/*
+Apply a partial config update from a PATCH request body, and save it to conf.json. Only the fields
+given are changed, and the whole update is refused if any of them can't be changed at runtime.
+*/
+func updateConfig(r *http.Request) error {
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return &TaskError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("Invalid config update: %s", err),
+		}
+	}
+
+	failures := []string{}
+	for name := range fields {
+		if !mutableConfigFields[name] {
+			failures = append(failures, fmt.Sprintf("%s can't be changed at runtime, edit conf.json and restart the connector", name))
+		}
+	}
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return &TaskError{
+			Status: http.StatusBadRequest,
+			Code:   "restart_required",
+			Errors: failures,
+			Err:    fmt.Errorf("Invalid config update: %s", strings.Join(failures, "; ")),
+		}
+	}
+
+	configUpdateLock.Lock()
+	defer configUpdateLock.Unlock()
+
+	// Without a key the request couldn't be authenticated, so it may only set one
+	if getConfig().ApiKey == "" {
+		var key string
+		if len(fields) != 1 || json.Unmarshal(fields["key"], &key) != nil || key == "" {
+			return &TaskError{
+				Status: http.StatusForbidden,
+				Code:   "api_key_required",
+				Err:    fmt.Errorf("No API key is configured - set one with a PATCH of only `key` before changing other settings"),
+			}
+		}
+	}
+
+	// Build the update as a new config, so the running one is untouched until it has been saved
+	updated, err := withConfigFields(*getConfig(), fields)
+	if err != nil {
+		return &TaskError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("Invalid config update: %s", err),
+		}
+	}
+
+	// Save the change over conf.json as it is on disk, so values from an environment overlay aren't written into it
+	configPath, err := getAssetPath("conf.json")
+	if err != nil {
+		return err
+	}
+	saved, err := readConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	saved, err = withConfigFields(saved, fields)
+	if err != nil {
+		return err
+	}
+	if err := writeConfigFile(configPath, saved); err != nil {
+		return err
+	}
+
+	setConfig(&updated)
+
+	// Pools read the lifetime when they open, so those already open are given the new one
+	if _, ok := fields["db_conn_max_lifetime_seconds"]; ok {
+		applyDbConnMaxLifetime()
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	svcLogger.Infof("Config updated: %s", strings.Join(names, ", "))
+
+	return nil
+}
+
+/*
+Build a new config from a base config, with the fields given replacing its values. The base is copied through
+JSON, so the result shares no maps or slices with it, and a map given replaces the base's map whole rather
+than being merged into it - leaving a database out of `databases` removes it.
+*/
+func withConfigFields(base ConnectorConfig, fields map[string]json.RawMessage) (ConnectorConfig, error) {
+	var updated ConnectorConfig
+
+	data, err := json.Marshal(base)
+	if err != nil {
+		return updated, err
+	}
+
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return updated, err
+	}
+	for name, value := range fields {
+		merged[name] = value
+	}
+
+	data, err = json.Marshal(merged)
+	if err != nil {
+		return updated, err
+	}
+
+	err = json.Unmarshal(data, &updated)
+
+	return updated, err
+}
+
+/*
+Handle an HTTP request to the /admin/renew-cert URL - generate and start serving a new server certificate,
+and reload any client CA certificates
+*/
+func handleRenewCert(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		writeResponse(w, r, http.StatusMethodNotAllowed, JsonResponse{
+			Type: "error",
+			Body: "Certificate renewal must be requested with POST",
+		})
+		return
+	}
+
+	cert, err := renewServerCertificate()
+	if err != nil {
+		writeResponse(w, r, http.StatusInternalServerError, JsonResponse{
+			Type: "error",
+			Body: fmt.Sprintf("Unable to renew certificate: %s", err),
+		})
+		return
+	}
+
+	info, err := getCertificateInfo(cert)
+	if err != nil {
+		writeResponse(w, r, http.StatusInternalServerError, JsonResponse{
+			Type: "error",
+			Body: fmt.Sprintf("Unable to read renewed certificate: %s", err),
+		})
+		return
+	}
+
+	svcLogger.Infof("Server certificate renewed, fingerprint: %s", info.Fingerprint)
+
+	if len(getConfig().ClientCaPaths) > 0 {
+		if err := reloadClientCaPool(); err != nil {
+			writeResponse(w, r, http.StatusInternalServerError, JsonResponse{
+				Type: "error",
+				Body: fmt.Sprintf("Certificate renewed, but unable to reload client CA certificates: %s", err),
+			})
+			return
+		}
+		svcLogger.Info("Client CA certificates reloaded")
+	}
+
+	writeResponse(w, r, http.StatusOK, JsonResponse{
+		Type: "success",
+		Body: info,
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	AUDIT_LOG_FILE         = "audit.log"
+	AUDIT_STATEMENT_LENGTH = 1000 // Statements are truncated to this many characters in the audit log
+)
+
+var (
+	auditLog     *os.File // Opened on first use, and kept open for appending
+	auditLogLock sync.Mutex
+)
+
+/*
+A record of a single task run, written to the audit log as a line of JSON
+*/
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	TaskId     string    `json:"task_id"`
+	TaskType   string    `json:"task_type"`
+	SourceIP   string    `json:"source_ip"`
+	Statement  string    `json:"statement"`
+	Rows       int64     `json:"rows"` // Rows returned by a query, or affected by a statement
+	DurationMs int64     `json:"duration_ms"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+}
+
+/*
+Shorten a statement for logging, marking where it has been cut
+*/
+func truncateStatement(statement string, length int) string {
+	if len(statement) > length {
+		return statement[:length] + "..."
+	}
+
+	return statement
+}
+
+/*
+Count the rows returned or affected by a task from its result
+*/
+func countResultRows(result interface{}) int64 {
+	switch v := result.(type) {
+	case DbExecResult:
+		if v.RowsAffected != nil {
+			return *v.RowsAffected
+		}
+	case DbProcResult:
+		return countResultRows(v.ResultSets)
+	case []DbTable:
+		return int64(len(v))
+	case []map[string]interface{}:
+		return int64(len(v))
+	case DbExportResult:
+		return v.Rows
+	case NamedResultSets:
+		var count int64
+		for _, resultSet := range v.Results {
+			count += countResultRows(resultSet)
+		}
+		return count
+	case ColumnarResultSet:
+		if len(v.Columns) > 0 {
+			return int64(len(v.Data[v.Columns[0]]))
+		}
+	case []interface{}:
+		var count int64
+		for _, resultSet := range v {
+			count += countResultRows(resultSet)
+		}
+		return count
+	}
+
+	return 0
+}
+
+/*
+Append an entry for a completed task to the audit log. Audit entries are always written,
+whatever else is being logged, and a failure to write one is reported to the service log.
+*/
+func writeAuditEntry(task Task, sourceIP string, result interface{}, started time.Time, taskErr error) {
+
+	statement := truncateStatement(task.Payload, AUDIT_STATEMENT_LENGTH)
+
+	entry := AuditEntry{
+		Time:       started.UTC(),
+		TaskId:     task.Id,
+		TaskType:   task.Type,
+		SourceIP:   sourceIP,
+		Statement:  statement,
+		DurationMs: int64(time.Since(started) / time.Millisecond),
+		Success:    taskErr == nil,
+	}
+	if taskErr != nil {
+		entry.Error = taskErr.Error()
+	} else {
+		entry.Rows = countResultRows(result)
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		errCheck(err)
+		return
+	}
+
+	auditLogLock.Lock()
+	defer auditLogLock.Unlock()
+
+	if auditLog == nil {
+		path := getConfig().AuditLogPath
+		if path == "" {
+			path, err = getAssetPath(AUDIT_LOG_FILE)
+			if err != nil {
+				errCheck(err)
+				return
+			}
+		}
+
+		auditLog, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			auditLog = nil
+			errCheck(err)
+			return
+		}
+	}
+
+	_, err = auditLog.Write(append(line, '\n'))
+	errCheck(err)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AZURE_TOKEN_ENDPOINT = "https://login.microsoftonline.com/%s/oauth2/v2.0/token"
+	AZURE_SQL_SCOPE      = "https://database.windows.net/.default"
+	AZURE_TOKEN_TIMEOUT  = 10 * time.Second
+	AZURE_TOKEN_REFRESH  = 5 * time.Minute // Fetch a new token when the cached one has less than this left
+)
+
+var (
+	azureTokens     = make(map[string]*azureToken) // Cached access tokens keyed by azureAuthKey
+	azureTokensLock sync.Mutex
+	azureClient     = &http.Client{Timeout: AZURE_TOKEN_TIMEOUT}
+)
+
+/*
+Config for authenticating to Azure SQL with an Azure AD access token instead of a SQL login. Tokens are
+requested with the client credentials of an app registration, from the Azure AD endpoint for the tenant
+or a configured token endpoint.
+*/
+type AzureAuthConfig struct {
+	TenantId      string `json:"tenant_id"`
+	ClientId      string `json:"client_id"`
+	ClientSecret  string `json:"client_secret"`
+	TokenEndpoint string `json:"token_endpoint"` // Overrides the Azure AD endpoint for the tenant
+	Scope         string `json:"scope"`          // Defaults to the Azure SQL scope
+}
+
+/*
+An access token and when it expires
+*/
+type azureToken struct {
+	value   string
+	expires time.Time
+}
+
+/*
+Build a token provider for the MSSQL driver's access token connector. The driver calls it for each new
+connection, so the cached token is refreshed before it expires without reopening the pool.
+*/
+func newAzureTokenProvider(authConfig AzureAuthConfig) func() (string, error) {
+	return func() (string, error) {
+		return getAzureToken(authConfig)
+	}
+}
+
+/*
+Get an access token for the config, reusing a cached token until it is close to expiring
+*/
+func getAzureToken(authConfig AzureAuthConfig) (string, error) {
+	endpoint := authConfig.TokenEndpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf(AZURE_TOKEN_ENDPOINT, url.PathEscape(authConfig.TenantId))
+	}
+	scope := authConfig.Scope
+	if scope == "" {
+		scope = AZURE_SQL_SCOPE
+	}
+	key := azureAuthKey(authConfig)
+
+	azureTokensLock.Lock()
+	defer azureTokensLock.Unlock()
+
+	if token, ok := azureTokens[key]; ok && time.Until(token.expires) > AZURE_TOKEN_REFRESH {
+		return token.value, nil
+	}
+
+	token, err := requestAzureToken(endpoint, authConfig.ClientId, authConfig.ClientSecret, scope)
+	if err != nil {
+		return "", err
+	}
+	azureTokens[key] = token
+
+	svcLogger.Infof("Azure access token for client %s refreshed, expires %s", authConfig.ClientId, token.expires.Format(time.RFC3339))
+
+	return token.value, nil
+}
+
+/*
+Identify the client credentials and scope a config requests tokens with. The secret is included as a hash,
+so a config with the right client ID but the wrong secret doesn't share another's token or connection pool.
+*/
+func azureAuthKey(authConfig AzureAuthConfig) string {
+	secret := sha256.Sum256([]byte(authConfig.ClientSecret))
+
+	return strings.Join([]string{
+		authConfig.TenantId,
+		authConfig.TokenEndpoint,
+		authConfig.ClientId,
+		authConfig.Scope,
+		hex.EncodeToString(secret[:]),
+	}, "|")
+}
+
+/*
+Request an access token from the token endpoint with the client credentials grant
+*/
+func requestAzureToken(endpoint string, clientId string, clientSecret string, scope string) (*azureToken, error) {
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {clientId},
+		"client_secret": {clientSecret},
+		"scope":         {scope},
+	}
+
+	resp, err := azureClient.Post(endpoint, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to request an Azure access token: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1048576))
+	if err != nil {
+		return nil, err
+	}
+
+	// Some token endpoints send expires_in as a string, so it's decoded as a number either way
+	var tokenResponse struct {
+		AccessToken      string      `json:"access_token"`
+		ExpiresIn        json.Number `json:"expires_in"`
+		ErrorDescription string      `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return nil, fmt.Errorf("Unable to read the Azure token response: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || tokenResponse.AccessToken == "" {
+		return nil, fmt.Errorf("Azure access token request failed with status %d: %s", resp.StatusCode, tokenResponse.ErrorDescription)
+	}
+
+	expiresIn, err := tokenResponse.ExpiresIn.Int64()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid expires_in in the Azure token response: %s", tokenResponse.ExpiresIn)
+	}
+
+	return &azureToken{
+		value:   tokenResponse.AccessToken,
+		expires: time.Now().Add(time.Duration(expiresIn) * time.Second),
+	}, nil
+}
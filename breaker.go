@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	CIRCUIT_BREAKER_FAILURES = 5  // Consecutive connection failures that open a database's circuit breaker
+	CIRCUIT_BREAKER_COOLDOWN = 30 // Seconds an open breaker fails tasks fast before letting one through to test the database
+)
+
+var (
+	circuitBreakers     = make(map[string]*circuitBreaker) // Breakers keyed by database type and DSN
+	circuitBreakersLock sync.Mutex
+)
+
+/*
+Tracks connection failures to one database. Closed while the database is reachable, open after repeated
+failures, and half-open once the cooldown has passed, when a single task is let through to test it.
+*/
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+	testing   bool // A half-open test connection is in progress
+}
+
+/*
+Connect to a database and check it responds, through its circuit breaker. While the breaker is open, tasks
+fail straight away with a 503 rather than each waiting out the connect timeout.
+*/
+func connectDb(ctx context.Context, dbConfig TaskDbConfig, timeout time.Duration) (*sql.DB, error) {
+	key := dbConfig.Type + "|" + dbConfig.Dsn
+
+	if err := checkCircuit(key, dbConfig.Type); err != nil {
+		return nil, err
+	}
+
+	db, err := openAndPingDb(ctx, dbConfig, timeout)
+
+	// A cancelled task says nothing about the database
+	if ctx.Err() == nil {
+		recordConnectResult(key, dbConfig.Type, err)
+	} else {
+		releaseCircuitTest(key)
+	}
+
+	return db, err
+}
+
+/*
+Open the pool for a database, through its SSH tunnel if it has one, and ping it
+*/
+func openAndPingDb(ctx context.Context, dbConfig TaskDbConfig, timeout time.Duration) (*sql.DB, error) {
+	dbConfig, err := applySshTunnel(dbConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := getDbPool(dbConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return db, pingDb(ctx, db, timeout)
+}
+
+/*
+Refuse a connection while a database's breaker is open. Once the cooldown has passed, one connection is
+let through to test the database, and others are refused until it succeeds or fails.
+*/
+func checkCircuit(key string, dbType string) error {
+	circuitBreakersLock.Lock()
+	defer circuitBreakersLock.Unlock()
+
+	breaker, ok := circuitBreakers[key]
+	if !ok || breaker.openUntil.IsZero() {
+		return nil
+	}
+
+	if remaining := time.Until(breaker.openUntil); remaining > 0 || breaker.testing {
+		if remaining < 0 {
+			remaining = 0
+		}
+		return newCircuitOpenError(dbType, remaining)
+	}
+
+	breaker.testing = true
+
+	return nil
+}
+
+/*
+Update a database's breaker with the outcome of a connection - a success closes it, and enough consecutive
+failures, or a failed test connection, open it for the cooldown
+*/
+func recordConnectResult(key string, dbType string, err error) {
+	circuitBreakersLock.Lock()
+	defer circuitBreakersLock.Unlock()
+
+	if err == nil {
+		if breaker, ok := circuitBreakers[key]; ok && !breaker.openUntil.IsZero() {
+			svcLogger.Infof("The %s database is reachable again, closing its circuit breaker", dbType)
+		}
+		delete(circuitBreakers, key)
+		return
+	}
+
+	breaker, ok := circuitBreakers[key]
+	if !ok {
+		breaker = &circuitBreaker{}
+		circuitBreakers[key] = breaker
+	}
+	breaker.failures++
+
+	threshold := getConfig().CircuitBreakerFailures
+	if threshold <= 0 {
+		threshold = CIRCUIT_BREAKER_FAILURES
+	}
+
+	if breaker.testing || breaker.failures >= threshold {
+		cooldown := configSeconds(getConfig().CircuitBreakerCooldownSeconds, CIRCUIT_BREAKER_COOLDOWN)
+		breaker.openUntil = time.Now().Add(cooldown)
+		breaker.testing = false
+		svcLogger.Warningf("Opening the circuit breaker for a %s database after %d failed connections, for %s: %s", dbType, breaker.failures, cooldown, err)
+	}
+}
+
+/*
+Let another connection test a half-open breaker, when the one testing it was cancelled before it found out
+*/
+func releaseCircuitTest(key string) {
+	circuitBreakersLock.Lock()
+	defer circuitBreakersLock.Unlock()
+
+	if breaker, ok := circuitBreakers[key]; ok {
+		breaker.testing = false
+	}
+}
+
+/*
+Error returned for a task refused while its database's circuit breaker is open
+*/
+func newCircuitOpenError(dbType string, remaining time.Duration) *TaskError {
+	return &TaskError{
+		Status: http.StatusServiceUnavailable,
+		Code:   "db_circuit_open",
+		Err:    fmt.Errorf("The %s database is unavailable after repeated connection failures, retrying in %ds", dbType, int(remaining.Seconds())+1),
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	mssql "github.com/denisenkom/go-mssqldb"
+	"regexp"
+	"strings"
+)
+
+const (
+	BULK_INSERT_BATCH_ROWS = 500   // Rows inserted by each multi-row INSERT statement
+	BULK_INSERT_MAX_ARGS   = 65535 // Placeholders allowed in a single statement by the MySQL protocol
+)
+
+var (
+	columnNamePattern = regexp.MustCompile(`^[\w\[\]]+$`) // Column names may be bracket quoted
+)
+
+/*
+Insert the task's rows into the table named in its payload, within a single transaction so a failure
+part way through leaves nothing behind. MSSQL rows are sent with the driver's bulk copy, other databases
+with batched multi-row INSERT statements.
+*/
+func processDbBulkInsert(ctx context.Context, task Task) (DbExecResult, error) {
+
+	var response DbExecResult
+
+	table := strings.TrimSpace(task.Payload)
+	if !procNamePattern.MatchString(table) {
+		return response, fmt.Errorf("Invalid table name: %s", table)
+	}
+	if len(task.Columns) == 0 {
+		return response, fmt.Errorf("Bulk inserts need a list of columns")
+	}
+	for _, column := range task.Columns {
+		if !columnNamePattern.MatchString(column) {
+			return response, fmt.Errorf("Invalid column name: %s", column)
+		}
+	}
+
+	rows := make([][]interface{}, len(task.Rows))
+	for i, row := range task.Rows {
+		if len(row) != len(task.Columns) {
+			return response, fmt.Errorf("Row %d has %d values, expected %d", i+1, len(row), len(task.Columns))
+		}
+		rows[i] = make([]interface{}, len(row))
+		for j, value := range row {
+			rows[i][j] = convertNumber(value)
+		}
+	}
+
+	fmt.Println(fmt.Sprintf("Bulk inserting %d rows into %s", len(rows), table))
+
+	dbConfig, err := getTaskDbConfig(task)
+	if err != nil {
+		return response, err
+	}
+
+	db, err := initDbConnection(ctx, task)
+	if err != nil {
+		return response, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return response, err
+	}
+	defer tx.Rollback()
+
+	var inserted int64
+	if dbConfig.Type == "mssql" {
+		inserted, err = bulkCopyRows(ctx, tx, table, task.Columns, rows)
+	} else {
+		inserted, err = insertRowBatches(ctx, tx, dbConfig.Type, table, task.Columns, rows)
+	}
+	if err != nil {
+		return response, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return response, err
+	}
+
+	return newDbExecResult(nil, &inserted), nil
+}
+
+/*
+Send rows to MSSQL with the driver's bulk copy API, which streams them in far faster than INSERT statements
+*/
+func bulkCopyRows(ctx context.Context, tx *sql.Tx, table string, columns []string, rows [][]interface{}) (int64, error) {
+	stmt, err := tx.PrepareContext(ctx, mssql.CopyIn(table, mssql.BulkOptions{}, columns...))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	for i, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			return 0, err
+		}
+		reportProgress(ctx, int64(i+1))
+	}
+
+	// Executing without values flushes the buffered rows to the server
+	result, err := stmt.ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+/*
+Insert rows with multi-row INSERT statements, batched to keep each statement within the driver's placeholder limit
+*/
+func insertRowBatches(ctx context.Context, tx *sql.Tx, dbType string, table string, columns []string, rows [][]interface{}) (int64, error) {
+	batchSize := BULK_INSERT_BATCH_ROWS
+	if maxRows := BULK_INSERT_MAX_ARGS / len(columns); maxRows < batchSize {
+		batchSize = maxRows
+	}
+	if batchSize < 1 {
+		return 0, fmt.Errorf("Too many columns for a bulk insert: %d", len(columns))
+	}
+
+	var inserted int64
+	for start := 0; start < len(rows); start += batchSize {
+		end := start + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		query, args := buildInsertBatch(dbType, table, columns, rows[start:end])
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return inserted, err
+		}
+		count, _ := result.RowsAffected()
+		inserted += count
+		reportProgress(ctx, inserted)
+	}
+
+	return inserted, nil
+}
+
+/*
+Build a single statement inserting a batch of rows e.g. "INSERT INTO t (a, b) VALUES (?, ?), (?, ?)".
+Oracle has no multi-row VALUES, so uses "INSERT ALL INTO t (a, b) VALUES (:1, :2) ... SELECT 1 FROM dual".
+*/
+func buildInsertBatch(dbType string, table string, columns []string, rows [][]interface{}) (string, []interface{}) {
+	columnList := strings.Join(columns, ", ")
+	args := make([]interface{}, 0, len(rows)*len(columns))
+	tuples := make([]string, 0, len(rows))
+
+	for _, row := range rows {
+		placeholders := make([]string, len(row))
+		for i, value := range row {
+			args = append(args, value)
+			placeholders[i] = placeholder(dbType, len(args))
+		}
+		tuples = append(tuples, "("+strings.Join(placeholders, ", ")+")")
+	}
+
+	if dbType == "oracle" {
+		into := fmt.Sprintf("INTO %s (%s) VALUES ", table, columnList)
+		return "INSERT ALL " + into + strings.Join(tuples, " "+into) + " SELECT 1 FROM dual", args
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", table, columnList, strings.Join(tuples, ", ")), args
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	resultCache     = make(map[string]*cachedResult) // Cached query results keyed by a hash of the database, SQL, params and output options
+	resultCacheLock sync.Mutex
+)
+
+/*
+A query result held in memory until it expires
+*/
+type cachedResult struct {
+	result  interface{}
+	created time.Time
+	expires time.Time
+}
+
+/*
+Build the cache key for a query task from everything that affects its result
+*/
+func resultCacheKey(task Task) (string, error) {
+	dbConfig, err := getTaskDbConfig(task)
+	if err != nil {
+		return "", err
+	}
+
+	// A tunnelled database is identified by the tunnel as well, as its DSN names the far end of the tunnel
+	var tunnel string
+	if dbConfig.SshTunnel != nil {
+		tunnel = sshTunnelKey(*dbConfig.SshTunnel)
+	}
+
+	keyData, _ := json.Marshal([]interface{}{
+		dbPoolKey(dbConfig),
+		dbConfig.Dsns,
+		tunnel,
+		dbConfig.Charset,
+		task.Type,
+		task.Payload,
+		task.SeedStatements,
+		task.Params,
+		task.ParamTypes,
+		task.ProcParams,
+		task.AllResultSets,
+		task.ResultKeys,
+		task.ColumnMap,
+		task.OutputFormat,
+		task.SelectColumns,
+		task.Distinct,
+		task.Explain,
+		task.AsRawJson,
+		task.Sample,
+		task.Transforms,
+		getConfig().FieldCase,
+		getConfig().TimeFormat,
+		getConfig().DecimalFormat,
+	})
+	hash := sha256.Sum256(keyData)
+
+	return hex.EncodeToString(hash[:]), nil
+}
+
+/*
+Get an unexpired cached result, along with its age
+*/
+func getCachedResult(key string) (interface{}, time.Duration, bool) {
+	resultCacheLock.Lock()
+	defer resultCacheLock.Unlock()
+
+	cached, ok := resultCache[key]
+	if !ok {
+		return nil, 0, false
+	}
+
+	now := time.Now()
+	if now.After(cached.expires) {
+		delete(resultCache, key)
+		return nil, 0, false
+	}
+
+	return cached.result, now.Sub(cached.created), true
+}
+
+/*
+Cache a result for the given duration, clearing out any expired results
+*/
+func storeCachedResult(key string, result interface{}, ttl time.Duration) {
+	now := time.Now()
+
+	resultCacheLock.Lock()
+	defer resultCacheLock.Unlock()
+
+	for k, cached := range resultCache {
+		if now.After(cached.expires) {
+			delete(resultCache, k)
+		}
+	}
+
+	resultCache[key] = &cachedResult{
+		result:  result,
+		created: now,
+		expires: now.Add(ttl),
+	}
+}
+
+/*
+Remove every cached result, returning how many were removed
+*/
+func clearResultCache() int {
+	resultCacheLock.Lock()
+	defer resultCacheLock.Unlock()
+
+	count := len(resultCache)
+	resultCache = make(map[string]*cachedResult)
+
+	return count
+}
+
+/*
+Handle an HTTP request to the /admin/cache/clear URL - discard all cached query results
+*/
+func handleClearCache(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		writeResponse(w, r, http.StatusMethodNotAllowed, JsonResponse{
+			Type: "error",
+			Body: "Clearing the cache must be requested with POST",
+		})
+		return
+	}
+
+	count := clearResultCache()
+	svcLogger.Infof("Result cache cleared, %d results removed", count)
+
+	writeResponse(w, r, http.StatusOK, JsonResponse{
+		Type: "success",
+		Body: map[string]interface{}{
+			"cleared": count,
+		},
+	})
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CERT_FILE     = "server.cert.pem"
+	KEY_FILE      = "server.key.pem"
+	CERT_VALIDITY = 365 * 24 * time.Hour
+	CERT_ORG      = "Digistorm"
+	CA_CERT_FILE  = "certs/ca/ca.crt"
+	CA_KEY_FILE   = "certs/ca/ca.key"
+	CA_VALIDITY   = 10 * 365 * 24 * time.Hour
+
+	SESSION_TICKET_ROTATION = 3600 // Seconds between session ticket key rotations
+	SESSION_TICKET_KEYS     = 2    // Keys kept for decrypting tickets, so tickets issued just before a rotation still resume
+)
+
+var (
+	serverCert     *tls.Certificate            // Generated certificate, served when no host certificate matches
+	serverCertHost string                      // Host(s) the generated certificate is issued for
+	serverCertLock sync.RWMutex                // Guards serverCert while it is renewed
+	hostCerts      map[string]*tls.Certificate // Configured certificates keyed by lower case host name
+
+	clientCaPool     *x509.CertPool // CAs client certificates must be issued by, when client certificates are required
+	clientCaPoolLock sync.RWMutex   // Guards clientCaPool while it is reloaded
+
+	// Holds the session ticket keys shared by every TLS listener. Servers clone their TLS config when they start,
+	// so tickets are encrypted through this config rather than keys set on each server's own.
+	sessionTicketConfig = &tls.Config{}
+)
+
+/*
+Details of the certificate being served, returned when it is renewed
+*/
+type CertificateInfo struct {
+	Fingerprint string    `json:"fingerprint"`
+	Expires     time.Time `json:"expires"`
+}
+
+/*
+A certificate/key pair to serve for a particular host name, selected using the client's SNI
+*/
+type CertificateConfig struct {
+	Host     string `json:"host"`
+	CertPath string `json:"cert_path"`
+	KeyPath  string `json:"key_path"`
+}
+
+/*
+Generate a self-signed certificate and private key for a comma separated list of hosts,
+plus any configured SAN entries, returning both as PEM encoded blocks
+*/
+func generateCertificate(host string) (certPEM []byte, keyPEM []byte, err error) {
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	org := getConfig().CertOrg
+	if org == "" {
+		org = CERT_ORG
+	}
+
+	notBefore := time.Now()
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{org},
+			CommonName:   getConfig().CertCommonName,
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(CERT_VALIDITY),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	seen := make(map[string]bool)
+	for _, entry := range append(strings.Split(host, ","), getConfig().CertSANs...) {
+		h := certSubjectHost(entry)
+		if h == "" || seen[h] {
+			continue
+		}
+		seen[h] = true
+
+		// IP literals belong in the IP SANs - clients won't match them against DNS names
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	// Sign with the CA if one has been set up with -init-ca, otherwise the certificate signs itself
+	caCert, caKey, err := loadCertificateAuthority()
+	if err != nil {
+		return nil, nil, err
+	}
+	parent, signer := &template, privateKey
+	if caCert != nil {
+		parent, signer = caCert, caKey
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, parent, &privateKey.PublicKey, signer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	if caCert != nil {
+		// Serve the CA certificate as part of the chain
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})...)
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+
+	return certPEM, keyPEM, nil
+}
+
+/*
+Get the paths of the CA certificate and key, from the config or the defaults beside the executable
+*/
+func getCaPaths() (certPath string, keyPath string, err error) {
+	certPath, keyPath = getConfig().CaCertPath, getConfig().CaKeyPath
+	if certPath == "" {
+		if certPath, err = getAssetPath(CA_CERT_FILE); err != nil {
+			return "", "", err
+		}
+	}
+	if keyPath == "" {
+		if keyPath, err = getAssetPath(CA_KEY_FILE); err != nil {
+			return "", "", err
+		}
+	}
+
+	return certPath, keyPath, nil
+}
+
+/*
+Generate a CA key/cert pair for signing server certificates, writing them to the CA paths.
+An existing CA is never overwritten, as clients that trust it would stop trusting the connector.
+*/
+func initCertificateAuthority() error {
+
+	certPath, keyPath, err := getCaPaths()
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{certPath, keyPath} {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("A CA already exists at %s, remove it first to create a new one", path)
+		}
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	org := getConfig().CertOrg
+	if org == "" {
+		org = CERT_ORG
+	}
+
+	notBefore := time.Now()
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{org},
+			CommonName:   org + " Connector CA",
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(CA_VALIDITY),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range []string{certPath, keyPath} {
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+	}
+	if err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}), 0644); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}), 0600); err != nil {
+		return err
+	}
+
+	fmt.Println(fmt.Sprintf("CA certificate written to %s, install it on clients to trust the connector", certPath))
+
+	return nil
+}
+
+/*
+Load the CA created by -init-ca, returning a nil certificate if there isn't one
+*/
+func loadCertificateAuthority() (*x509.Certificate, *rsa.PrivateKey, error) {
+
+	certPath, keyPath, err := getCaPaths()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM, err := ioutil.ReadFile(certPath)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, fmt.Errorf("Unable to decode the CA at %s", certPath)
+	}
+
+	caCert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	caKey, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return caCert, caKey, nil
+}
+
+/*
+Reduce a host entry to the bare host name or IP for a certificate SAN, removing any port
+and IPv6 brackets e.g. "127.0.0.1:8081" => "127.0.0.1", "[::1]:8081" => "::1"
+*/
+func certSubjectHost(entry string) string {
+	h := strings.TrimSpace(entry)
+	if host, _, err := net.SplitHostPort(h); err == nil {
+		h = host
+	}
+
+	return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(h, "["), "]"))
+}
+
+/*
+Generate a new certificate for the given host(s), writing the cert/key pair to disk if `PersistCerts` is configured
+*/
+func newServerCertificate(host string) (*tls.Certificate, error) {
+
+	certPEM, keyPEM, err := generateCertificate(host)
+	if err != nil {
+		return nil, err
+	}
+
+	if getConfig().PersistCerts {
+		certPath, err := getAssetPath(CERT_FILE)
+		if err != nil {
+			return nil, err
+		}
+		keyPath, err := getAssetPath(KEY_FILE)
+		if err != nil {
+			return nil, err
+		}
+		if err = ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+			return nil, err
+		}
+		if err = ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	return &cert, err
+}
+
+/*
+Build the certificate the server will present. The certificate is held in memory only,
+unless `PersistCerts` is configured, in which case an existing cert/key pair is reused
+from disk or a newly generated pair is written there.
+*/
+func loadServerCertificate(host string) (*tls.Certificate, error) {
+
+	serverCertHost = host
+
+	if getConfig().PersistCerts {
+		certPath, err := getAssetPath(CERT_FILE)
+		if err != nil {
+			return nil, err
+		}
+		keyPath, err := getAssetPath(KEY_FILE)
+		if err != nil {
+			return nil, err
+		}
+
+		// Reuse the persisted pair if it is available
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err == nil {
+			return &cert, nil
+		}
+	}
+
+	return newServerCertificate(host)
+}
+
+/*
+Replace the generated server certificate - new TLS handshakes will use it immediately,
+while established connections are unaffected
+*/
+func setServerCertificate(cert *tls.Certificate) {
+	serverCertLock.Lock()
+	defer serverCertLock.Unlock()
+
+	serverCert = cert
+}
+
+/*
+Generate and start serving a fresh server certificate
+*/
+func renewServerCertificate() (*tls.Certificate, error) {
+	cert, err := newServerCertificate(serverCertHost)
+	if err != nil {
+		return nil, err
+	}
+
+	setServerCertificate(cert)
+
+	return cert, nil
+}
+
+/*
+Describe a certificate by its SHA-256 fingerprint and expiry
+*/
+func getCertificateInfo(cert *tls.Certificate) (CertificateInfo, error) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return CertificateInfo{}, err
+	}
+
+	fingerprint := sha256.Sum256(leaf.Raw)
+
+	return CertificateInfo{
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		Expires:     leaf.NotAfter,
+	}, nil
+}
+
+/*
+Load the configured per-host certificates, keyed by lower case host name
+*/
+func loadHostCertificates(certConfigs []CertificateConfig) (map[string]*tls.Certificate, error) {
+
+	certs := make(map[string]*tls.Certificate)
+
+	for _, certConfig := range certConfigs {
+		cert, err := tls.LoadX509KeyPair(certConfig.CertPath, certConfig.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load certificate for host %s: %s", certConfig.Host, err)
+		}
+		certs[strings.ToLower(certConfig.Host)] = &cert
+	}
+
+	return certs, nil
+}
+
+/*
+Supply a certificate to the TLS handshake - the configured certificate for the requested
+SNI host name if there is one, otherwise the generated server certificate
+*/
+func getServerCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert, ok := hostCerts[strings.ToLower(hello.ServerName)]; ok {
+		return cert, nil
+	}
+
+	serverCertLock.RLock()
+	defer serverCertLock.RUnlock()
+
+	return serverCert, nil
+}
+
+/*
+Generate a new session ticket key every interval, keeping the previous keys so recently issued tickets can
+still be decrypted. Old keys are discarded, so a key leaked later can't decrypt sessions from long before.
+*/
+func rotateSessionTicketKeys(interval time.Duration) error {
+	keys := [][32]byte{}
+
+	rotate := func() error {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+
+		keys = append([][32]byte{key}, keys...)
+		if len(keys) > SESSION_TICKET_KEYS {
+			keys = keys[:SESSION_TICKET_KEYS]
+		}
+		sessionTicketConfig.SetSessionTicketKeys(keys)
+
+		return nil
+	}
+
+	// The first key must be in place before any handshake, so a failure here stops the connector starting
+	if err := rotate(); err != nil {
+		return err
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			if err := rotate(); err != nil {
+				svcLogger.Errorf("Couldn't rotate session ticket keys: %s", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+/*
+Build a pool of the CA certificates client certificates may be issued by, from PEM files and directories of
+them. Every certificate in a file is added, so a bundle can hold a rollover CA alongside the current one.
+*/
+func loadClientCaPool(paths []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	count := 0
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read client CA path %s: %s", path, err)
+		}
+
+		files := []string{path}
+		if info.IsDir() {
+			entries, err := ioutil.ReadDir(path)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read client CA directory %s: %s", path, err)
+			}
+			files = files[:0]
+			for _, entry := range entries {
+				ext := strings.ToLower(filepath.Ext(entry.Name()))
+				if !entry.IsDir() && (ext == ".pem" || ext == ".crt") {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+
+		for _, file := range files {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read client CA certificate %s: %s", file, err)
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("No certificates found in client CA file %s", file)
+			}
+			count++
+		}
+	}
+
+	if count == 0 {
+		return nil, fmt.Errorf("No client CA certificates found in %s", strings.Join(paths, ", "))
+	}
+
+	return pool, nil
+}
+
+/*
+Read the configured client CA certificates again, so CAs added or removed during a rotation take effect for
+new TLS handshakes. The current pool is kept if they can't be read.
+*/
+func reloadClientCaPool() error {
+	pool, err := loadClientCaPool(getConfig().ClientCaPaths)
+	if err != nil {
+		return err
+	}
+
+	clientCaPoolLock.Lock()
+	defer clientCaPoolLock.Unlock()
+
+	clientCaPool = pool
+
+	return nil
+}
+
+/*
+Require and verify a client certificate on TLS handshakes when client CAs are configured, checking it
+against the CA pool current at the time of the handshake
+*/
+func requireClientCertificates(tlsConfig *tls.Config) {
+	if len(getConfig().ClientCaPaths) == 0 {
+		return
+	}
+
+	base := tlsConfig.Clone()
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		clientCaPoolLock.RLock()
+		defer clientCaPoolLock.RUnlock()
+
+		handshakeConfig := base.Clone()
+		handshakeConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		handshakeConfig.ClientCAs = clientCaPool
+
+		return handshakeConfig, nil
+	}
+}
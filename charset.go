@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"unicode/utf8"
+)
+
+/*
+Get a decoder from a database's configured `charset` to UTF-8, by any of the names browsers accept for it
+e.g. "windows-1252", "latin1" or "iso-8859-15"
+*/
+func charsetDecoder(charset string) (*encoding.Decoder, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, newDbConfigError(fmt.Errorf("charset %q is not a known character set", charset))
+	}
+
+	return enc.NewDecoder(), nil
+}
+
+/*
+Transcode the text values of a result set from a database's charset to UTF-8, in place. Only values that
+aren't valid UTF-8 are decoded, as drivers already convert some column types themselves e.g. NVARCHAR,
+and decoding those again would garble them.
+*/
+func transcodeRows(rows []map[string]interface{}, decoder *encoding.Decoder) error {
+	for _, row := range rows {
+		for column, value := range row {
+			var data []byte
+			switch v := value.(type) {
+			case string:
+				if utf8.ValidString(v) {
+					continue
+				}
+				data = []byte(v)
+			case []byte:
+				if utf8.Valid(v) {
+					continue
+				}
+				data = v
+			default:
+				continue
+			}
+
+			decoded, err := decoder.Bytes(data)
+			if err != nil {
+				return fmt.Errorf("Unable to decode column %s: %s", column, err)
+			}
+			row[column] = string(decoded)
+		}
+	}
+
+	return nil
+}
@@ -2,42 +2,156 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	_ "github.com/denisenkom/go-mssqldb"
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/kabukky/httpscerts"
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
 	"github.com/kardianos/osext"
 	"github.com/kardianos/service"
-	"github.com/markokeeffe/mapquery"
+	_ "github.com/sijms/go-ora/v2"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"io/ioutil"
 	"log"
+	_ "modernc.org/sqlite"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	HOST                     = "127.0.0.1"
-	PORT                     = "8081"
-	AUTH_USER                = "digistormconnector"
-	TASK_TYPE_DB_MYSQL_QUERY = "mysql.query"
-	TASK_TYPE_DB_MYSQL_EXEC  = "mysql.exec"
-	TASK_TYPE_DB_MSSQL_QUERY = "mssql.query"
-	TASK_TYPE_DB_MSSQL_EXEC  = "mssql.exec"
+	HOST                      = "127.0.0.1"
+	PORT                      = "8081"
+	AUTH_USER                 = "digistormconnector"
+	BIND_RETRY_ATTEMPTS       = 5
+	BIND_RETRY_DELAY          = 1   // Seconds before the first retry, doubling with each attempt
+	REQUEST_TIMEOUT           = 10  // Seconds allowed for non-task requests
+	TASK_TIMEOUT              = 300 // Seconds allowed for a task request, including writing the result
+	IDLE_TIMEOUT              = 120 // Seconds an idle keep-alive connection is kept open
+	SHUTDOWN_TIMEOUT          = 5   // Seconds in-flight requests are given to finish when the connector stops
+	DB_CONNECT_TIMEOUT        = 15  // Seconds allowed to reach the database before a task gives up
+	SLOW_QUERY_LENGTH         = 200 // Statements are truncated to this many characters in the slow query log
+	TASK_TYPE_DB_MYSQL_QUERY  = "mysql.query"
+	TASK_TYPE_DB_MYSQL_EXEC   = "mysql.exec"
+	TASK_TYPE_DB_MSSQL_QUERY  = "mssql.query"
+	TASK_TYPE_DB_MSSQL_EXEC   = "mssql.exec"
+	TASK_TYPE_DB_MARIA_QUERY  = "mariadb.query"
+	TASK_TYPE_DB_MARIA_EXEC   = "mariadb.exec"
+	TASK_TYPE_DB_ORACLE_QUERY = "oracle.query"
+	TASK_TYPE_DB_ORACLE_EXEC  = "oracle.exec"
+	TASK_TYPE_DB_INTROSPECT   = "db.introspect"
+	TASK_TYPE_DB_CALLPROC     = "db.callproc"
+	TASK_TYPE_DB_DIAGNOSTIC   = "db.diagnostic"
+	TASK_TYPE_DB_SUBSCRIBE    = "postgres.subscribe"
+	TASK_TYPE_DB_BULK_INSERT  = "db.bulkinsert"
+	TASK_TYPE_DB_SQLITE_QUERY = "sqlite.query"
 )
 
 var (
-	svcLogger service.Logger  // Will write logs to the Windows event viewer
-	svcFlag   string          // Service control flag e.g. "start" "stop" "uninstall"...
-	config    ConnectorConfig // Config vars
+	svcLogger service.Logger // Will write logs to the Windows event viewer
+	svcFlag   string         // Service control flag e.g. "start" "stop" "uninstall"...
+	initCa    bool           // Generate a CA to sign server certificates with, then exit
+	strict    bool           // Refuse to start without an API key, rather than waiting for one to be set
+	printConf bool           // Print the effective config, with secrets redacted, then exit
+	version   = "dev"        // Set at build time with `-ldflags "-X main.version=1.2.3"`
+	startedAt = time.Now()   // When the connector started, for reporting uptime
+
+	runningConfig atomic.Value // *ConnectorConfig - replaced whole on update and never modified, so readers don't lock
+
+	servers     []*http.Server // Running servers, one per listener
+	serversLock sync.Mutex
+
+	// Database types that are opened with a differently named driver
+	dbDrivers = map[string]string{
+		"mariadb": "mysql",
+	}
+
+	// Matches statements that return rows from an INSERT/UPDATE/DELETE e.g. MariaDB's `INSERT ... RETURNING id`
+	returningPattern = regexp.MustCompile(`(?i)\bRETURNING\b`)
+
+	// Every task type the connector can process
+	taskTypes = map[string]bool{
+		TASK_TYPE_DB_MYSQL_QUERY:  true,
+		TASK_TYPE_DB_MYSQL_EXEC:   true,
+		TASK_TYPE_DB_MSSQL_QUERY:  true,
+		TASK_TYPE_DB_MSSQL_EXEC:   true,
+		TASK_TYPE_DB_MARIA_QUERY:  true,
+		TASK_TYPE_DB_MARIA_EXEC:   true,
+		TASK_TYPE_DB_ORACLE_QUERY: true,
+		TASK_TYPE_DB_ORACLE_EXEC:  true,
+		TASK_TYPE_DB_INTROSPECT:   true,
+		TASK_TYPE_DB_CALLPROC:     true,
+		TASK_TYPE_DB_DIAGNOSTIC:   true,
+		TASK_TYPE_DB_SUBSCRIBE:    true,
+		TASK_TYPE_DB_BULK_INSERT:  true,
+		TASK_TYPE_DB_SQLITE_QUERY: true,
+	}
+
+	// Queries used to list the schemas and tables visible to a connection, keyed by database type
+	introspectQueries = map[string]string{
+		"mysql": "SELECT table_schema, table_name, table_type FROM information_schema.tables " +
+			"WHERE table_schema NOT IN ('information_schema', 'mysql', 'performance_schema', 'sys') " +
+			"ORDER BY table_schema, table_name",
+		"mariadb": "SELECT table_schema, table_name, table_type FROM information_schema.tables " +
+			"WHERE table_schema NOT IN ('information_schema', 'mysql', 'performance_schema', 'sys') " +
+			"ORDER BY table_schema, table_name",
+		"mssql": "SELECT TABLE_SCHEMA, TABLE_NAME, TABLE_TYPE FROM INFORMATION_SCHEMA.TABLES " +
+			"ORDER BY TABLE_SCHEMA, TABLE_NAME",
+		"oracle": "SELECT owner, table_name, 'BASE TABLE' FROM all_tables " +
+			"WHERE owner NOT IN ('SYS', 'SYSTEM') " +
+			"UNION ALL SELECT owner, view_name, 'VIEW' FROM all_views " +
+			"WHERE owner NOT IN ('SYS', 'SYSTEM') " +
+			"ORDER BY 1, 2",
+	}
+
+	// Queries listing the columns of every table and view, in the same order as the tables, keyed by database type
+	introspectColumnQueries = map[string]string{
+		"mysql": "SELECT table_schema, table_name, column_name, column_type, is_nullable, column_default " +
+			"FROM information_schema.columns " +
+			"WHERE table_schema NOT IN ('information_schema', 'mysql', 'performance_schema', 'sys') " +
+			"ORDER BY table_schema, table_name, ordinal_position",
+		"mariadb": "SELECT table_schema, table_name, column_name, column_type, is_nullable, column_default " +
+			"FROM information_schema.columns " +
+			"WHERE table_schema NOT IN ('information_schema', 'mysql', 'performance_schema', 'sys') " +
+			"ORDER BY table_schema, table_name, ordinal_position",
+		"mssql": "SELECT TABLE_SCHEMA, TABLE_NAME, COLUMN_NAME, DATA_TYPE + CASE " +
+			"WHEN CHARACTER_MAXIMUM_LENGTH = -1 THEN '(MAX)' " +
+			"WHEN CHARACTER_MAXIMUM_LENGTH IS NOT NULL THEN '(' + CAST(CHARACTER_MAXIMUM_LENGTH AS VARCHAR(10)) + ')' " +
+			"WHEN DATA_TYPE IN ('decimal', 'numeric') THEN '(' + CAST(NUMERIC_PRECISION AS VARCHAR(10)) + ',' + CAST(NUMERIC_SCALE AS VARCHAR(10)) + ')' " +
+			"ELSE '' END, IS_NULLABLE, COLUMN_DEFAULT FROM INFORMATION_SCHEMA.COLUMNS " +
+			"ORDER BY TABLE_SCHEMA, TABLE_NAME, ORDINAL_POSITION",
+		"oracle": "SELECT owner, table_name, column_name, data_type || CASE " +
+			"WHEN data_type IN ('VARCHAR2', 'NVARCHAR2', 'CHAR', 'NCHAR') THEN '(' || char_length || ')' " +
+			"WHEN data_type = 'NUMBER' AND data_precision IS NOT NULL THEN '(' || data_precision || ',' || data_scale || ')' " +
+			"ELSE '' END, CASE nullable WHEN 'Y' THEN 'YES' ELSE 'NO' END, data_default FROM all_tab_columns " +
+			"WHERE owner NOT IN ('SYS', 'SYSTEM') " +
+			"ORDER BY owner, table_name, column_id",
+	}
+
+	// Queries returning the server version and current database name, keyed by database type
+	diagnosticQueries = map[string]string{
+		"mysql":   "SELECT VERSION(), DATABASE()",
+		"mariadb": "SELECT VERSION(), DATABASE()",
+		"mssql":   "SELECT @@VERSION, DB_NAME()",
+		"oracle":  "SELECT (SELECT banner FROM v$version WHERE ROWNUM = 1), SYS_CONTEXT('USERENV', 'DB_NAME') FROM dual",
+	}
 )
 
 /*
@@ -54,9 +168,96 @@ type ConnectorConfig struct {
 	ApiKey string `json:"key"`
 	Host   string `json:"host"`
 	Port   string `json:"port"`
+
+	PersistCerts  bool                `json:"persist_certs"`   // Write the generated certificate and key to disk for reuse
+	Certificates  []CertificateConfig `json:"certificates"`    // Certificates to serve for specific host names
+	ClientCaPaths []string            `json:"client_ca_paths"` // CA certificate files or directories of them - clients must present a certificate issued by one
+
+	CertOrg        string   `json:"cert_org"`         // Organization for the generated certificate, defaults to "Digistorm"
+	CertCommonName string   `json:"cert_common_name"` // Common name for the generated certificate
+	CertSANs       []string `json:"cert_sans"`        // Additional host names/IPs for the generated certificate
+	CaCertPath     string   `json:"ca_cert_path"`     // CA certificate generated certificates are signed with, defaults to certs/ca/ca.crt
+	CaKeyPath      string   `json:"ca_key_path"`      // CA private key, defaults to certs/ca/ca.key
+
+	SessionTicketRotationSeconds int `json:"session_ticket_rotation_seconds"` // Interval between TLS session ticket key rotations, defaults to an hour
+
+	EnabledTaskTypes []string              `json:"enabled_task_types"` // Task types the connector will run, all known types when empty
+	TaskSchemas      map[string]TaskSchema `json:"task_schemas"`       // Extra rules tasks must follow, by task type, checked before they run
+
+	Databases map[string]TaskDbConfig `json:"databases"` // Named connections tasks can use with `db_name`, keeping DSNs off the wire
+	DsnVars   map[string]string       `json:"dsn_vars"`  // Values for placeholders like {host} and {password} in the DSNs of `databases`
+
+	DefaultDbType string `json:"default_db_type"` // Database type for tasks whose config doesn't give one e.g. "mssql"
+
+	DbConnMaxLifetimeSeconds int `json:"db_conn_max_lifetime_seconds"` // Close pooled connections older than this, 0 to keep them indefinitely
+	KeepAliveIntervalSeconds int `json:"keep_alive_interval_seconds"`  // Ping pooled connections this often to keep them warm, 0 to disable
+
+	ApplicationName string `json:"application_name"` // Name connections identify themselves with to SQL Server and Postgres, "DigistormConnector" when empty
+	SessionTimezone string `json:"session_timezone"` // Time zone set on every database connection e.g. "+00:00" or "Australia/Brisbane", the server's own when empty
+
+	PrettyResponses bool `json:"pretty_responses"` // Indent all JSON responses, as if `?pretty=1` were given
+
+	RawResponses bool `json:"raw_responses"` // Write task results without the JsonResponse envelope
+
+	FieldCase string `json:"field_case"` // Result column naming - "as_is" (the default), "snake" or "camel"
+
+	TimeFormat string `json:"time_format"` // Layout for date/time values in results - "rfc3339", "rfc3339nano" or a Go layout e.g. "2006-01-02 15:04:05", as the driver returns them when empty
+
+	DecimalFormat string `json:"decimal_format"` // Encoding for DECIMAL/NUMERIC/MONEY values in results - "string" (the default) to keep every digit, or "number"
+
+	AuthFailureLimit         int `json:"auth_failure_limit"`          // Failed authentication attempts allowed from an IP within the window
+	AuthFailureWindowSeconds int `json:"auth_failure_window_seconds"` // Window in which failed attempts are counted
+	AuthLockoutSeconds       int `json:"auth_lockout_seconds"`        // How long an IP is blocked once it exceeds the limit
+
+	MaxConnectionsPerIp int `json:"max_connections_per_ip"` // Open connections allowed from one client IP, 0 for no limit
+
+	RequestTimeoutSeconds int `json:"request_timeout_seconds"` // Time allowed for non-task requests, and for reading any request
+	TaskTimeoutSeconds    int `json:"task_timeout_seconds"`    // Time allowed for a /task request
+
+	AuditLogPath string `json:"audit_log_path"` // File every task run is recorded in, defaults to audit.log beside the executable
+
+	ExportPaths []string `json:"export_paths"` // Directories query results may be written to with `output_file_path`, none when empty
+
+	AccessLog      bool   `json:"access_log"`       // Log every HTTP request to the service log
+	AccessLogLevel string `json:"access_log_level"` // Level access log lines are written at - "info" (the default), "warning" or "error"
+
+	StartupDelaySeconds     int  `json:"startup_delay_seconds"`       // Wait this long after starting before running tasks
+	WaitForDbOnStart        bool `json:"wait_for_db_on_start"`        // Hold tasks back at startup until the configured databases respond
+	WaitForDbTimeoutSeconds int  `json:"wait_for_db_timeout_seconds"` // Longest to wait for the databases before running tasks anyway
+
+	CircuitBreakerFailures        int `json:"circuit_breaker_failures"`         // Consecutive connection failures before tasks to a database fail fast, defaults to 5
+	CircuitBreakerCooldownSeconds int `json:"circuit_breaker_cooldown_seconds"` // How long tasks fail fast before a connection is tried again, defaults to 30
+
+	BindRetryAttempts     int `json:"bind_retry_attempts"`      // Attempts to bind the server port before giving up
+	BindRetryDelaySeconds int `json:"bind_retry_delay_seconds"` // Delay before the first retry, doubled after each attempt
+
+	TaskWorkers   int `json:"task_workers"`    // Tasks run at once, 32 when 0
+	TaskQueueSize int `json:"task_queue_size"` // Tasks waiting for a worker before more are refused with a 503, 256 when 0
+
+	TCPKeepAliveSeconds int `json:"tcp_keep_alive_seconds"` // Interval between TCP keepalive probes on client connections, -1 to turn them off, Go's default of 15 when 0
+
+	Listeners []ListenerConfig `json:"listeners"` // Addresses to serve on, defaults to TLS on host:port
+
+	MaxResponseBytes int64 `json:"max_response_bytes"` // Fail tasks whose encoded result is larger than this, 0 for no limit
+	MaxColumns       int   `json:"max_columns"`        // Fail query tasks with a result set wider than this many columns, 0 for no limit
+
+	Maintenance                  bool `json:"maintenance"`                     // Start in maintenance mode, turning task requests away
+	MaintenanceRetryAfterSeconds int  `json:"maintenance_retry_after_seconds"` // Retry-After sent with tasks turned away during maintenance
+
+	TrustedProxies []string `json:"trusted_proxies"` // Reverse proxies (IPs or CIDR ranges) whose X-Forwarded-For/X-Real-IP headers are believed
+
+	AllowedOrigins []string `json:"allowed_origins"` // Browser origins allowed to call the connector e.g. "https://admin.myschool.qld.edu.au", CORS is off when empty
+
+	IdempotencyTTLSeconds int `json:"idempotency_ttl_seconds"` // How long results are kept for repeated idempotency keys
+
+	SlowQueryMs int `json:"slow_query_ms"` // Log a warning for statements that take longer than this, 0 to disable
+
+	RedactVerboseLogs bool `json:"redact_verbose_logs"` // Keep statements and params out of the logs of `verbose` tasks
+
+	OtlpEndpoint string `json:"otlp_endpoint"` // OTLP/HTTP collector URL to export traces to e.g. "http://collector:4318", tracing is off when empty
 }
 
-/**
+/*
 Container for the executable program that can be run as a service
 */
 type Program struct {
@@ -65,38 +266,171 @@ type Program struct {
 	Cmd     *exec.Cmd
 }
 
-/**
+/*
 A task from the API to be executed locally, then a JSON response returned
 */
 type Task struct {
 	Id        string          `json:"id"`
 	RawConfig json.RawMessage `json:"config"`
+	DbName    string          `json:"db_name"` // Use a database from the connector's config instead of an inline config
 	Type      string          `json:"type"`
 	Payload   string          `json:"payload"`
+	Params    json.RawMessage `json:"params"` // Values to bind - an array for positional placeholders, or an object for `:name` placeholders
+
+	ParamTypes []string `json:"param_types"` // Type to bind each positional param as e.g. "int", "string", "float", "bool", "time" or "null"
+
+	AllResultSets   bool              `json:"all_result_sets"`  // Always return an array of result sets, even if there is only one
+	ResultKeys      []string          `json:"result_keys"`      // Name each result set of a batch, in order, returning them keyed by name
+	ProcParams      []TaskProcParam   `json:"proc_params"`      // Parameters for a stored procedure call
+	ColumnMap       map[string]string `json:"column_map"`       // Rename result columns, old name => new name
+	Columns         []string          `json:"columns"`          // Columns a bulk insert sets, in the order of each row's values
+	Rows            [][]interface{}   `json:"rows"`             // Values for a bulk insert, one array per row
+	Envelope        *bool             `json:"envelope"`         // Override the RawResponses config for this task
+	OutputFormat    string            `json:"output_format"`    // Lay result sets out as "rows" (the default) or "columnar"
+	SelectColumns   []string          `json:"select_columns"`   // Only return these result columns e.g. from a generated `SELECT *`
+	Distinct        bool              `json:"distinct"`         // Remove rows that exactly duplicate an earlier row in the result
+	Transforms      map[string]string `json:"transforms"`       // Transform result columns after fetching, column name => "trim", "upper", "lower" or "iso8601"
+	PreviewAffected bool              `json:"preview_affected"` // Return the rows an UPDATE/DELETE affects along with its result
+	Explain         bool              `json:"explain"`          // Return the plan the database would use for a query, instead of running it
+	AsRawJson       bool              `json:"as_raw_json"`      // Embed JSON column values, and SQL Server FOR JSON output, as JSON rather than strings
+	Sample          int               `json:"sample"`           // Return only the first this many rows of each result set, as a preview
+	Verbose         bool              `json:"verbose"`          // Log each step of this task, with its statement and params, whatever the global logging
+	OutputFilePath  string            `json:"output_file_path"` // Write a query result to this file, within the export paths, instead of returning it
+	SeedStatements  []string          `json:"seed_statements"`  // Statements populating the in-memory database of a `sqlite.query` task before its query runs
+
+	CursorColumn string          `json:"cursor_column"` // Page through a query's rows in order of this column, which should be unique
+	CursorValue  json.RawMessage `json:"cursor_value"`  // Return the page after this value of the cursor column, or the first page when absent
+	CursorLimit  int             `json:"cursor_limit"`  // Rows in each page, defaults to 1000
+
+	CacheTTLSeconds       int `json:"cache_ttl_seconds"`       // Cache a query result and serve identical queries from it for this long
+	ConnectTimeoutSeconds int `json:"connect_timeout_seconds"` // Time allowed to reach the database, separate from the time the query may run
+
+	IdempotencyKey string `json:"idempotency_key"` // Repeats of a key return the first run's result instead of running again
 }
 
-/**
+/*
 Config for a DB task to initialise the DB connection
 */
 type TaskDbConfig struct {
-	Type string `json:"type"`
-	Dsn  string `json:"dsn"`
+	Type      string            `json:"type"`
+	Dsn       string            `json:"dsn"`
+	Dsns      []string          `json:"dsns,omitempty"`       // Ordered DSNs query tasks try in turn e.g. replicas then the primary
+	SshTunnel *SshTunnelConfig  `json:"ssh_tunnel,omitempty"` // Reach the database through an SSH bastion host
+	AzureAuth *AzureAuthConfig  `json:"azure_auth,omitempty"` // Authenticate to Azure SQL with an Azure AD access token
+	DsnVars   map[string]string `json:"dsn_vars,omitempty"`   // Placeholder values for this database, overriding the connector's `dsn_vars`
+
+	InitStatements []string `json:"init_statements,omitempty"` // Session setup run on every new connection e.g. "SET ANSI_NULLS ON"
+	Charset        string   `json:"charset,omitempty"`         // Character set text is stored in, for databases that don't return UTF-8 e.g. "windows-1252"
+
+	MaxConcurrentQueries int `json:"max_concurrent_queries,omitempty"` // Tasks run against this database at once, 0 for no limit
+	MinConnections       int `json:"min_connections,omitempty"`        // Connections opened as soon as the pool is created, ready for the first tasks
 }
 
 /*
 A wrapper for the information returned when executing an INSERT/DELETE query
 */
 type DbExecResult struct {
-	LastInsertId int64 `json:"last_insert_id"`
-	RowsAffected int64 `json:"rows_affected"`
+	LastInsertId    *int64      `json:"last_insert_id"` // null when the driver can't provide it, rather than an ambiguous 0
+	RowsAffected    *int64      `json:"rows_affected"`
+	LastInsertIdStr *string     `json:"last_insert_id_str"` // As a string, as JavaScript loses precision on integers above 2^53
+	RowsAffectedStr *string     `json:"rows_affected_str"`
+	Returning       interface{} `json:"returning,omitempty"` // Rows returned by a MariaDB `RETURNING` clause
+	Preview         interface{} `json:"preview,omitempty"`   // Rows an UPDATE/DELETE affected, as they were before it ran
+	Category        string      `json:"category,omitempty"`  // "ddl" for schema changes, which have no row counts
+	Object          *DbObject   `json:"object,omitempty"`    // The object a schema change created, altered or dropped
+}
+
+/*
+A table or view found when introspecting a database
+*/
+type DbTable struct {
+	Schema  string     `json:"schema"`
+	Name    string     `json:"name"`
+	Type    string     `json:"type"`
+	Columns []DbColumn `json:"columns"`
+}
+
+/*
+A column of an introspected table, with its native type e.g. "VARCHAR(255)"
+*/
+type DbColumn struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Nullable bool    `json:"nullable"`
+	Default  *string `json:"default"` // null when the column has no default
+}
+
+/*
+An address to serve on. Plaintext listeners must be bound to a loopback address, for local agents only.
+*/
+type ListenerConfig struct {
+	Addr string `json:"addr"` // Host and port e.g. "127.0.0.1:8082"
+	TLS  bool   `json:"tls"`
+}
+
+/*
+Status details reported by the root URL
+*/
+type ConnectorStatus struct {
+	Message          string `json:"message"`
+	Version          string `json:"version"`
+	UptimeSeconds    int64  `json:"uptime_seconds"`
+	DbPools          int    `json:"db_pools"` // Database connection pools currently open
+	ApiKeyConfigured bool   `json:"api_key_configured"`
+}
+
+/*
+The result of a diagnostic task, confirming the database can be reached
+*/
+type DbDiagnostic struct {
+	Version   string  `json:"version"`
+	Database  string  `json:"database"`
+	LatencyMs float64 `json:"latency_ms"` // Round trip time of the version query
 }
 
-/**
+/*
 Used to return responses to the task server e.g. `{"type": "error", "body": "Invalid API Key."}`
 */
 type JsonResponse struct {
-	Type string      `json:"type"`
-	Body interface{} `json:"body"`
+	Type        string       `json:"type"`
+	Body        interface{}  `json:"body"`
+	Code        string       `json:"code,omitempty"`
+	DbErrorCode string       `json:"db_error_code,omitempty"`
+	DbSqlState  string       `json:"db_sqlstate,omitempty"`
+	Errors      []string     `json:"errors,omitempty"`
+	Meta        ResponseMeta `json:"meta,omitempty"`
+}
+
+/*
+Extra details about how a task's result was produced e.g. `{"cached": true}`
+*/
+type ResponseMeta map[string]interface{}
+
+/*
+The bare error object written in place of a JsonResponse when the response envelope is disabled
+*/
+type RawErrorResponse struct {
+	Error       string   `json:"error"`
+	Code        string   `json:"code,omitempty"`
+	DbErrorCode string   `json:"db_error_code,omitempty"`
+	DbSqlState  string   `json:"db_sqlstate,omitempty"`
+	Errors      []string `json:"errors,omitempty"`
+}
+
+/*
+An error raised while processing a task, carrying the HTTP status and any error codes to report
+*/
+type TaskError struct {
+	Status      int
+	Code        string   // Machine readable error category e.g. "panic"
+	DbErrorCode string   // Driver's native error number e.g. "1062"
+	DbSqlState  string   // SQLSTATE of the error, where the driver reports one e.g. "23000"
+	Errors      []string // Individual failures e.g. each invalid field of a task
+	Err         error
+}
+
+func (e *TaskError) Error() string {
+	return e.Err.Error()
 }
 
 /*
@@ -113,6 +447,25 @@ func getAssetPath(name string) (string, error) {
 	return filepath.Join(dir, name), nil
 }
 
+/*
+Get the running config. Updates publish a new config rather than changing this one, so it must be treated
+as read only
+*/
+func getConfig() *ConnectorConfig {
+	if running, ok := runningConfig.Load().(*ConnectorConfig); ok {
+		return running
+	}
+
+	return &ConnectorConfig{}
+}
+
+/*
+Publish a config for tasks and requests to run with from now on
+*/
+func setConfig(updated *ConnectorConfig) {
+	runningConfig.Store(updated)
+}
+
 /*
 Read in configuration from a JSON config file
 */
@@ -136,9 +489,9 @@ func readConfigFile(configPath string) (connectorConfig ConnectorConfig, err err
 /*
 Write configuration to a JSON config file
 */
-func writeConfigFile(configPath string) error {
+func writeConfigFile(configPath string, connectorConfig ConnectorConfig) error {
 
-	configData, err := json.Marshal(config)
+	configData, err := json.Marshal(connectorConfig)
 	if err != nil {
 		return err
 	}
@@ -162,7 +515,12 @@ func processConfig() error {
 	apiKey := flag.String("key", "", "Digistorm API Key.")
 	host := flag.String("host", HOST, "Host name for this server e.g. '184.33.65.12' or 'digistorm.myschool.qld.edu.au'")
 	port := flag.String("port", PORT, "Port numer for tist server. Must be open to incoming requests at the firewall. e.g. 8081")
+	persistCerts := flag.Bool("persist-certs", false, "Write the generated TLS certificate and key to disk and reuse them on restart.")
+	env := flag.String("env", os.Getenv("CONNECTOR_ENV"), "Environment whose config overlay e.g. 'conf.prod.json' is applied over conf.json.")
 	flag.StringVar(&svcFlag, "service", "", "Control the system service.")
+	flag.BoolVar(&initCa, "init-ca", false, "Generate a CA key/cert pair to sign server certificates with, then exit.")
+	flag.BoolVar(&strict, "strict", false, "Exit if no API key is configured, instead of starting and waiting for one to be set.")
+	flag.BoolVar(&printConf, "print-config", false, "Print the effective config, after flags and the environment overlay are applied, with secrets redacted, then exit.")
 
 	flag.Parse()
 
@@ -175,28 +533,67 @@ func processConfig() error {
 
 	// Attempt to read config from a file, but do not return an error if it isn't there,
 	// we can write to the file after processing the command line arguments
-	config, err = readConfigFile(configPath)
+	loaded, err := readConfigFile(configPath)
 	if err != nil {
 		log.Println(err)
 	}
-	if config.ApiKey == "" || (config.ApiKey != *apiKey && *apiKey != "") {
-		config.ApiKey = *apiKey
+	if loaded.ApiKey == "" || (loaded.ApiKey != *apiKey && *apiKey != "") {
+		loaded.ApiKey = *apiKey
+		configUpdate = true
+	}
+	if loaded.Host == "" || (loaded.Host != *host && *host != HOST) {
+		loaded.Host = *host
 		configUpdate = true
 	}
-	if config.Host == "" || (config.Host != *host && *host != HOST) {
-		config.Host = *host
+	if loaded.Port == "" || (loaded.Port != *port && *port != PORT) {
+		loaded.Port = *port
 		configUpdate = true
 	}
-	if config.Port == "" || (config.Port != *port && *port != PORT) {
-		config.Port = *port
+	if *persistCerts && !loaded.PersistCerts {
+		loaded.PersistCerts = true
 		configUpdate = true
 	}
 
 	if configUpdate == true {
-		err = writeConfigFile(configPath)
+		err = writeConfigFile(configPath, loaded)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The overlay is applied after saving, so its values never end up in the base config file
+	if *env != "" {
+		overlayPath, err := getAssetPath("conf." + *env + ".json")
 		if err != nil {
 			return err
 		}
+		err = applyConfigOverlay(overlayPath, &loaded)
+		if err != nil {
+			return err
+		}
+	}
+
+	setConfig(&loaded)
+
+	return nil
+}
+
+/*
+Apply an environment's config overlay - fields set in the overlay replace the base config's values,
+while fields it leaves out keep them
+*/
+func applyConfigOverlay(overlayPath string, loaded *ConnectorConfig) error {
+
+	file, err := os.Open(overlayPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Decoding over the loaded config only replaces the fields present in the overlay
+	err = json.NewDecoder(file).Decode(loaded)
+	if err != nil {
+		return fmt.Errorf("Invalid config overlay %s: %s", overlayPath, err)
 	}
 
 	return nil
@@ -209,7 +606,11 @@ func parseTask(data []byte) (Task, error) {
 
 	var task Task
 
-	err := json.Unmarshal(data, &task)
+	// Decode numbers exactly, so large integer values (e.g. stored procedure params) aren't rounded through float64
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	err := decoder.Decode(&task)
 	if err != nil {
 		return task, err
 	}
@@ -217,230 +618,1375 @@ func parseTask(data []byte) (Task, error) {
 	fmt.Print("Task received: ")
 	fmt.Println(task.Id)
 
+	// Site specific rules from the config are checked alongside the connector's own
+	failures := append(checkTaskSchema(task.Type, data), validateTask(task)...)
+	if len(failures) > 0 {
+		return task, &TaskError{
+			Status: http.StatusBadRequest,
+			Errors: failures,
+			Err:    fmt.Errorf("Invalid task: %s", strings.Join(failures, "; ")),
+		}
+	}
+
 	return task, err
 }
 
 /*
-Get DB specific config to initialise a database connection
+Refuse a task type the connector hasn't been configured to run. All known types are enabled if none are listed.
 */
-func getTaskDbConfig(task Task) TaskDbConfig {
-	var dbConfig TaskDbConfig
-	err := json.Unmarshal(task.RawConfig, &dbConfig)
-	errCheck(err)
-	fmt.Print("Database Configuration: ")
-	fmt.Println(dbConfig)
+func checkTaskTypeEnabled(taskType string) error {
+	if len(getConfig().EnabledTaskTypes) == 0 {
+		return nil
+	}
 
-	return dbConfig
+	for _, enabled := range getConfig().EnabledTaskTypes {
+		if enabled == taskType {
+			return nil
+		}
+	}
+
+	return &TaskError{
+		Status: http.StatusForbidden,
+		Code:   "task_type_disabled",
+		Err:    fmt.Errorf("Task type %s is not enabled on this connector", taskType),
+	}
 }
 
 /*
-Initialise database connection based on the task type
+Check a decoded task for missing or invalid fields, returning every problem found so they can be reported at once
 */
-func initDbConnection(task Task) *sql.DB {
-	fmt.Println("Initilising Database Connection...")
-	config := getTaskDbConfig(task)
-	db, err := sql.Open(config.Type, config.Dsn)
-	errCheck(err)
+func validateTask(task Task) []string {
 
-	return db
-}
+	failures := []string{}
 
-/*
-Open a DB connection, execute a query and POST the result back to the API
-*/
-func processDbQuery(task Task) (interface{}, error) {
+	if task.Type == "" {
+		failures = append(failures, "type is required")
+	} else if !taskTypes[task.Type] {
+		failures = append(failures, fmt.Sprintf("type %q is not a known task type", task.Type))
+	}
 
-	fmt.Print("Querying database: ")
-	fmt.Println(task.Payload)
+	// Every task type runs against a database, so needs a usable connection config or a configured database
+	if task.DbName != "" {
+		if len(task.RawConfig) > 0 {
+			failures = append(failures, "config and db_name can't both be given")
+		}
+		if _, ok := getConfig().Databases[task.DbName]; !ok {
+			failures = append(failures, fmt.Sprintf("db_name %q is not a configured database", task.DbName))
+		}
+	} else if len(task.RawConfig) == 0 {
+		failures = append(failures, "config or db_name is required")
+	} else {
+		var dbConfig TaskDbConfig
+		if err := json.Unmarshal(task.RawConfig, &dbConfig); err != nil {
+			failures = append(failures, fmt.Sprintf("config is invalid: %s", err))
+		} else if dbConfig.Dsn == "" && len(dbConfig.Dsns) == 0 {
+			failures = append(failures, "config.dsn is required")
+		}
+	}
 
-	db := initDbConnection(task)
-	db.SetMaxIdleConns(100)
-	defer db.Close()
+	if task.Payload == "" && task.Type != TASK_TYPE_DB_INTROSPECT && task.Type != TASK_TYPE_DB_DIAGNOSTIC {
+		failures = append(failures, "payload is required")
+	}
 
-	rows, err := db.Query(task.Payload)
-	if err != nil {
-		return nil, err
+	if task.OutputFilePath != "" {
+		switch task.Type {
+		case TASK_TYPE_DB_MYSQL_QUERY, TASK_TYPE_DB_MSSQL_QUERY, TASK_TYPE_DB_MARIA_QUERY, TASK_TYPE_DB_ORACLE_QUERY, TASK_TYPE_DB_SQLITE_QUERY:
+			if _, err := checkExportPath(task.OutputFilePath); err != nil {
+				failures = append(failures, fmt.Sprintf("output_file_path is invalid: %s", err))
+			}
+		default:
+			failures = append(failures, "output_file_path can only be given for query tasks")
+		}
 	}
 
-	mappedRows, err := mapquery.MapRows(rows)
+	if len(task.ResultKeys) > 0 {
+		switch task.Type {
+		case TASK_TYPE_DB_MYSQL_QUERY, TASK_TYPE_DB_MSSQL_QUERY, TASK_TYPE_DB_MARIA_QUERY, TASK_TYPE_DB_ORACLE_QUERY, TASK_TYPE_DB_SQLITE_QUERY:
+		default:
+			failures = append(failures, "result_keys can only be given for query tasks")
+		}
+		seen := make(map[string]bool, len(task.ResultKeys))
+		for i, key := range task.ResultKeys {
+			if key == "" {
+				failures = append(failures, fmt.Sprintf("result_keys[%d] is empty", i))
+			} else if seen[key] {
+				failures = append(failures, fmt.Sprintf("result_keys[%d] %q is given more than once", i, key))
+			}
+			seen[key] = true
+		}
+	}
 
-	return mappedRows, err
-}
+	if task.Sample != 0 {
+		switch task.Type {
+		case TASK_TYPE_DB_MYSQL_QUERY, TASK_TYPE_DB_MSSQL_QUERY, TASK_TYPE_DB_MARIA_QUERY, TASK_TYPE_DB_ORACLE_QUERY, TASK_TYPE_DB_SQLITE_QUERY:
+		default:
+			failures = append(failures, "sample can only be given for query tasks")
+		}
+		if task.Sample < 0 {
+			failures = append(failures, "sample can't be negative")
+		}
+		if task.CursorColumn != "" {
+			failures = append(failures, "sample can't be combined with cursor_column, use cursor_limit to size pages")
+		}
+	}
 
-/*
-Open a DB connection, execute a query and POST the result back to the API
-*/
-func processDbExec(task Task) (DbExecResult, error) {
+	if task.AsRawJson {
+		switch task.Type {
+		case TASK_TYPE_DB_MYSQL_QUERY, TASK_TYPE_DB_MSSQL_QUERY, TASK_TYPE_DB_MARIA_QUERY, TASK_TYPE_DB_ORACLE_QUERY, TASK_TYPE_DB_SQLITE_QUERY:
+		default:
+			failures = append(failures, "as_raw_json can only be given for query tasks")
+		}
+	}
 
-	fmt.Print("Executing statement: ")
-	fmt.Println(task.Payload)
+	if task.Explain {
+		switch task.Type {
+		case TASK_TYPE_DB_MYSQL_QUERY, TASK_TYPE_DB_MSSQL_QUERY, TASK_TYPE_DB_MARIA_QUERY, TASK_TYPE_DB_ORACLE_QUERY, TASK_TYPE_DB_SQLITE_QUERY:
+		default:
+			failures = append(failures, "explain can only be given for query tasks")
+		}
+		if len(task.ResultKeys) > 0 || task.OutputFilePath != "" {
+			failures = append(failures, "explain can't be combined with result_keys or output_file_path")
+		}
+	}
 
-	db := initDbConnection(task)
-	db.SetMaxIdleConns(100)
-	defer db.Close()
+	if len(task.SeedStatements) > 0 && task.Type != TASK_TYPE_DB_SQLITE_QUERY {
+		failures = append(failures, fmt.Sprintf("seed_statements can only be given for %s tasks", TASK_TYPE_DB_SQLITE_QUERY))
+	}
 
-	var response DbExecResult
+	if task.CursorColumn != "" {
+		switch task.Type {
+		case TASK_TYPE_DB_MYSQL_QUERY, TASK_TYPE_DB_MSSQL_QUERY, TASK_TYPE_DB_MARIA_QUERY, TASK_TYPE_DB_ORACLE_QUERY, TASK_TYPE_DB_SQLITE_QUERY:
+		default:
+			failures = append(failures, "cursor_column can only be given for query tasks")
+		}
+		if !columnNamePattern.MatchString(task.CursorColumn) {
+			failures = append(failures, fmt.Sprintf("cursor_column %q is not a valid column name", task.CursorColumn))
+		}
+		if _, err := decodeCursorValue(task.CursorValue); err != nil {
+			failures = append(failures, err.Error())
+		}
+		if task.CursorLimit < 0 {
+			failures = append(failures, "cursor_limit can't be negative")
+		}
+	} else if len(task.CursorValue) > 0 || task.CursorLimit != 0 {
+		failures = append(failures, "cursor_value and cursor_limit need a cursor_column")
+	}
 
-	result, err := db.Exec(task.Payload)
-	if err != nil {
-		return response, err
+	for column, name := range task.Transforms {
+		if _, ok := columnTransforms[name]; !ok {
+			failures = append(failures, fmt.Sprintf("transforms: %q for column %s is not a known transform", name, column))
+		}
 	}
-	lastInsertId, _ := result.LastInsertId()
-	rowsAffected, _ := result.RowsAffected()
 
-	response = DbExecResult{
-		LastInsertId: lastInsertId,
-		RowsAffected: rowsAffected,
+	switch task.OutputFormat {
+	case "", OUTPUT_FORMAT_ROWS, OUTPUT_FORMAT_COLUMNAR, OUTPUT_FORMAT_MSGPACK:
+	default:
+		failures = append(failures, fmt.Sprintf("output_format %q is not %q, %q or %q", task.OutputFormat, OUTPUT_FORMAT_ROWS, OUTPUT_FORMAT_COLUMNAR, OUTPUT_FORMAT_MSGPACK))
 	}
 
-	return response, nil
+	positional, named, err := decodeParams(task.Params)
+	if err != nil {
+		failures = append(failures, fmt.Sprintf("params is invalid: %s", err))
+	} else if len(task.ParamTypes) > 0 {
+		// Type hints line up with positional params, so can't be given for named params
+		if named != nil {
+			failures = append(failures, "param_types can only be given with an array of params")
+		} else if len(task.ParamTypes) != len(positional) {
+			failures = append(failures, fmt.Sprintf("param_types has %d types for %d params", len(task.ParamTypes), len(positional)))
+		}
+		for i, paramType := range task.ParamTypes {
+			if !paramTypes[paramType] {
+				failures = append(failures, fmt.Sprintf("param_types[%d] %q is not a known type", i, paramType))
+			}
+		}
+	}
+
+	return failures
 }
 
 /*
-Parse HTTP request body for a task - should JSON decode the task and process it based on it's type
+Get DB specific config to initialise a database connection
 */
-func processTaskRequest(r *http.Request) (interface{}, error) {
-
-	var response interface{}
-
-	// Read the contents of the request body
-	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
-	if err != nil {
-		return response, err
-	}
-	if err := r.Body.Close(); err != nil {
-		return response, err
+func getTaskDbConfig(task Task) (TaskDbConfig, error) {
+	var dbConfig TaskDbConfig
+	if task.DbName != "" {
+		// The database may have been removed from the config since the task was validated
+		var ok bool
+		if dbConfig, ok = getConfig().Databases[task.DbName]; !ok {
+			return dbConfig, newDbConfigError(fmt.Errorf("db_name %q is not a configured database", task.DbName))
+		}
+		dbConfig = resolveDsnTemplates(dbConfig)
+	} else if err := json.Unmarshal(task.RawConfig, &dbConfig); err != nil {
+		return dbConfig, newDbConfigError(err)
 	}
 
-	// Attempt to JSON decode the request body into a Task struct
-	task, err := parseTask(body)
-	if err != nil {
-		return response, fmt.Errorf("Unable to parse JSON request body: %s", err)
+	// Single engine sites can leave the type out of their tasks
+	if dbConfig.Type == "" {
+		dbConfig.Type = getConfig().DefaultDbType
 	}
 
-	switch task.Type {
-	case TASK_TYPE_DB_MYSQL_QUERY, TASK_TYPE_DB_MSSQL_QUERY:
-		response, err = processDbQuery(task)
-		fmt.Println(response)
-		if err != nil {
-			err = fmt.Errorf("Database error: %s", err)
-		}
-	case TASK_TYPE_DB_MYSQL_EXEC, TASK_TYPE_DB_MSSQL_EXEC:
-		response, err = processDbExec(task)
-		if err != nil {
-			err = fmt.Errorf("Database error: %s", err)
+	if dbConfig.Charset != "" {
+		if _, err := charsetDecoder(dbConfig.Charset); err != nil {
+			return dbConfig, err
 		}
-	default:
-		return response, fmt.Errorf("Unknown task type: %s", task.Type)
 	}
 
-	return response, err
+	// Without a primary DSN, the first in the list is the primary
+	if dbConfig.Dsn == "" && len(dbConfig.Dsns) > 0 {
+		dbConfig.Dsn = dbConfig.Dsns[0]
+	}
+
+	return dbConfig, nil
 }
 
 /*
-Get the HTTP basic auth headers and check against the configured username and API key
+Fill placeholders like {host}, {user}, {password} and {db} in a configured database's DSNs, from its own
+`dsn_vars` or the connector's. Only databases in the connector's config are resolved - a task's own config
+could otherwise send the shared credentials to a server of its choosing. Unknown placeholders are left alone.
 */
-func checkAuth(w http.ResponseWriter, r *http.Request) bool {
-	s := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
-	if len(s) != 2 {
-		return false
+func resolveDsnTemplates(dbConfig TaskDbConfig) TaskDbConfig {
+	if len(getConfig().DsnVars) == 0 && len(dbConfig.DsnVars) == 0 {
+		return dbConfig
 	}
 
-	b, err := base64.StdEncoding.DecodeString(s[1])
-	if err != nil {
-		return false
+	replacements := []string{}
+	for name, value := range getConfig().DsnVars {
+		if _, ok := dbConfig.DsnVars[name]; !ok {
+			replacements = append(replacements, "{"+name+"}", value)
+		}
 	}
+	for name, value := range dbConfig.DsnVars {
+		replacements = append(replacements, "{"+name+"}", value)
+	}
+	replacer := strings.NewReplacer(replacements...)
 
-	pair := strings.SplitN(string(b), ":", 2)
-	if len(pair) != 2 {
-		return false
+	dbConfig.Dsn = replacer.Replace(dbConfig.Dsn)
+	if len(dbConfig.Dsns) > 0 {
+		dsns := make([]string, len(dbConfig.Dsns))
+		for i, dsn := range dbConfig.Dsns {
+			dsns[i] = replacer.Replace(dsn)
+		}
+		dbConfig.Dsns = dsns
 	}
 
-	return pair[0] == AUTH_USER && pair[1] == config.ApiKey
+	return dbConfig
 }
 
 /*
-Wrapper function to handle HTTP requests, checking HTTP basic authorisation credentials
+Create an error for a task whose database config can't be used, so it's refused rather than connecting with empty settings
 */
-func handleAuthMiddleware(w http.ResponseWriter, r *http.Request, handler func(http.ResponseWriter, *http.Request)) {
-	if checkAuth(w, r) {
-		handler(w, r)
-		return
+func newDbConfigError(err error) *TaskError {
+	return &TaskError{
+		Status: http.StatusBadRequest,
+		Code:   "invalid_db_config",
+		Err:    fmt.Errorf("Invalid database config: %s", err),
 	}
-
-	w.Header().Set("WWW-Authenticate", `Basic realm="MY REALM"`)
-	w.WriteHeader(401)
-	w.Write([]byte("401 Unauthorized\n"))
 }
 
 /*
-Handle an HTTP request to the / URL - display a success message
+Initialise database connection based on the task type, reusing an open connection pool where possible
 */
-func handleRoot(w http.ResponseWriter, r *http.Request) {
-	writeResponse(w, http.StatusOK, JsonResponse{
-		Type: "success",
-		Body: "Digistorm Connector Online",
-	})
+func initDbConnection(ctx context.Context, task Task) (*sql.DB, error) {
+	fmt.Println("Initilising Database Connection...")
+	config, err := getTaskDbConfig(task)
+	if err != nil {
+		return nil, err
+	}
+
+	return connectDb(ctx, config, configSeconds(task.ConnectTimeoutSeconds, DB_CONNECT_TIMEOUT))
 }
 
 /*
-Handle an HTTP request to the /task URL - should contain a JSON encoded task in the request body
+Initialise a database connection for a read-only task. With a list of DSNs configured, each is tried
+in order until one responds to a ping, so a replica that is down falls back to the next in the list.
 */
-func handleTask(w http.ResponseWriter, r *http.Request) {
-
-	rawResponse, err := processTaskRequest(r)
-
+func initDbQueryConnection(ctx context.Context, task Task) (*sql.DB, error) {
+	dbConfig, err := getTaskDbConfig(task)
 	if err != nil {
-		writeResponse(w, http.StatusInternalServerError, JsonResponse{
-			Type: "error",
-			Body: fmt.Sprintf("%s", err),
-		})
-		return
+		return nil, err
+	}
+	if len(dbConfig.Dsns) == 0 {
+		return initDbConnection(ctx, task)
 	}
 
-	writeResponse(w, http.StatusOK, JsonResponse{
-		Type: "success",
-		Body: rawResponse,
-	})
+	fmt.Println("Initilising Database Connection...")
 
-}
+	for _, dsn := range dbConfig.Dsns {
+		candidate := dbConfig
+		candidate.Dsn = dsn
 
-func writeResponse (w http.ResponseWriter, status int, response JsonResponse) {
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(status)
-	err := json.NewEncoder(w).Encode(response)
-	errCheck(err)
+		var db *sql.DB
+		db, err = connectDb(ctx, candidate, configSeconds(task.ConnectTimeoutSeconds, DB_CONNECT_TIMEOUT))
+		if err == nil {
+			return db, nil
+		}
+
+		// Don't try the rest of the list for a task that has been cancelled
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		svcLogger.Warningf("Database unavailable, trying the next DSN: %s", err)
+	}
+
+	return nil, err
+}
+
+/*
+Execute a query task, serving the result from the cache if the task allows it and an unexpired result is available
+*/
+func processDbQuery(ctx context.Context, task Task, meta ResponseMeta) (result interface{}, err error) {
+
+	ctx, span := tracer.Start(ctx, "processDbQuery")
+	setTaskSpanAttributes(span, task)
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	// The cache keeps results but not their meta, so cursor pages, whose next cursor is in the meta, aren't cached
+	if task.CacheTTLSeconds <= 0 || task.CursorColumn != "" {
+		started := time.Now()
+		defer logSlowQuery(task, started)
+		return fetchDbQuery(ctx, task, meta)
+	}
+
+	key, err := resultCacheKey(task)
+	if err != nil {
+		return nil, err
+	}
+	if result, age, ok := getCachedResult(key); ok {
+		meta["cached"] = true
+		meta["cache_age_seconds"] = int(age.Seconds())
+		return result, nil
+	}
+
+	started := time.Now()
+	result, err = fetchDbQuery(ctx, task, meta)
+	logSlowQuery(task, started)
+	if err != nil {
+		return nil, err
+	}
+
+	storeCachedResult(key, result, time.Duration(task.CacheTTLSeconds)*time.Second)
+	meta["cached"] = false
+
+	return result, nil
+}
+
+/*
+Open a DB connection, execute a query and POST the result back to the API
+*/
+func fetchDbQuery(ctx context.Context, task Task, meta ResponseMeta) (interface{}, error) {
+
+	fmt.Print("Querying database: ")
+	fmt.Println(task.Payload)
+
+	dbConfig, err := getTaskDbConfig(task)
+	if err != nil {
+		return nil, err
+	}
+
+	query, args, err := taskStatement(task, dbConfig.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	if task.CursorColumn != "" {
+		if query, args, err = cursorStatement(task, dbConfig.Type, query, args); err != nil {
+			return nil, &TaskError{
+				Status: http.StatusBadRequest,
+				Err:    err,
+			}
+		}
+	}
+
+	var db *sql.DB
+	if task.Type == TASK_TYPE_DB_SQLITE_QUERY {
+		db, err = openSqliteTestDb(ctx, task)
+		if err == nil {
+			defer db.Close()
+		}
+	} else {
+		db, err = initDbQueryConnection(ctx, task)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if task.Explain {
+		dbType := dbConfig.Type
+		if task.Type == TASK_TYPE_DB_SQLITE_QUERY {
+			dbType = "sqlite"
+		}
+		resultSets, err := explainQuery(ctx, db, dbType, query, args)
+		if err != nil {
+			return nil, err
+		}
+		meta["explain"] = true
+		if len(resultSets) == 1 && !task.AllResultSets {
+			return resultSets[0], nil
+		}
+		return resultSets, nil
+	}
+
+	rows, err := queryDb(ctx, db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	resultSets, err := mapResultSets(rows, func(rows *sql.Rows) (interface{}, error) {
+		return mapResultSet(task, dbConfig.Charset, rows, meta)
+	})
+	rows.Close()
+
+	// A column type the mapper can't handle shouldn't fail an otherwise useful query - run it again,
+	// returning the values it can't handle as strings. Any other error, from the database or the connection,
+	// would only fail again, and a statement that changes data mustn't run twice.
+	var mapperErr *MapperError
+	if errors.As(err, &mapperErr) && ctx.Err() == nil && isSingleSelect(query) {
+		svcLogger.Warningf("Unable to map query result, retrying with values coerced to strings: %s", err)
+		delete(meta, "warnings")
+		delete(meta, "duplicates_removed")
+		resultSets, err = fetchDegradedResultSets(ctx, db, task, dbConfig.Charset, query, args, meta)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(task.ResultKeys) > 0 {
+		return nameResultSets(resultSets, task.ResultKeys, meta), nil
+	}
+
+	// Keep single result set responses unwrapped, as they have always been
+	if len(resultSets) == 1 && !task.AllResultSets {
+		return resultSets[0], nil
+	}
+
+	return resultSets, nil
+}
+
+/*
+Build the result of an executed statement, including string copies of the numbers for JavaScript consumers.
+Values the driver couldn't provide are left nil, and written as null.
+*/
+func newDbExecResult(lastInsertId *int64, rowsAffected *int64) DbExecResult {
+	response := DbExecResult{
+		LastInsertId: lastInsertId,
+		RowsAffected: rowsAffected,
+	}
+	if lastInsertId != nil {
+		str := strconv.FormatInt(*lastInsertId, 10)
+		response.LastInsertIdStr = &str
+	}
+	if rowsAffected != nil {
+		str := strconv.FormatInt(*rowsAffected, 10)
+		response.RowsAffectedStr = &str
+	}
+
+	return response
+}
+
+/*
+Take a value from an sql.Result, or nil if the driver doesn't support it e.g. LastInsertId for MSSQL
+*/
+func execResultValue(value int64, err error) *int64 {
+	if err != nil {
+		return nil
+	}
+
+	return &value
+}
+
+/*
+Warn about a statement that took longer than the configured `SlowQueryMs`. Only the statement is
+logged - bound parameter values are left out, as they may hold personal details.
+*/
+func logSlowQuery(task Task, started time.Time) {
+	if getConfig().SlowQueryMs <= 0 {
+		return
+	}
+
+	elapsed := time.Since(started)
+	if elapsed <= time.Duration(getConfig().SlowQueryMs)*time.Millisecond {
+		return
+	}
+
+	svcLogger.Warningf("Slow query for task %s took %dms: %s", task.Id, elapsed.Milliseconds(), truncateStatement(task.Payload, SLOW_QUERY_LENGTH))
+}
+
+/*
+Open a DB connection, execute a query and POST the result back to the API
+*/
+func processDbExec(ctx context.Context, task Task, meta ResponseMeta) (DbExecResult, error) {
+
+	fmt.Print("Executing statement: ")
+	fmt.Println(task.Payload)
+
+	var response DbExecResult
+
+	dbConfig, err := getTaskDbConfig(task)
+	if err != nil {
+		return response, err
+	}
+
+	query, args, err := taskStatement(task, dbConfig.Type)
+	if err != nil {
+		return response, err
+	}
+
+	db, err := initDbConnection(ctx, task)
+	if err != nil {
+		return response, err
+	}
+
+	var preview interface{}
+	if task.PreviewAffected {
+		preview, err = previewAffectedRows(ctx, db, task, dbConfig, query, args, meta)
+		if err != nil {
+			return response, err
+		}
+	}
+
+	started := time.Now()
+	result, err := execDb(ctx, db, query, args...)
+	logSlowQuery(task, started)
+	if err != nil {
+		return response, err
+	}
+	// Row counts from schema changes are meaningless 0s or -1s, so describe the object changed instead
+	if object := parseDdlStatement(query); object != nil {
+		response = newDbExecResult(nil, nil)
+		response.Category = STATEMENT_CATEGORY_DDL
+		response.Object = object
+		return response, nil
+	}
+
+	response = newDbExecResult(execResultValue(result.LastInsertId()), execResultValue(result.RowsAffected()))
+	response.Preview = preview
+
+	return response, nil
+}
+
+/*
+Open a DB connection and execute a statement with a `RETURNING` clause, capturing the returned rows
+*/
+func processDbExecReturning(ctx context.Context, task Task, meta ResponseMeta) (DbExecResult, error) {
+
+	fmt.Print("Executing statement: ")
+	fmt.Println(task.Payload)
+
+	var response DbExecResult
+
+	dbConfig, err := getTaskDbConfig(task)
+	if err != nil {
+		return response, err
+	}
+
+	query, args, err := taskStatement(task, dbConfig.Type)
+	if err != nil {
+		return response, err
+	}
+
+	db, err := initDbConnection(ctx, task)
+	if err != nil {
+		return response, err
+	}
+
+	// Not retried on a stale connection, as the statement may have already run
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return response, err
+	}
+	defer rows.Close()
+
+	returning, err := mapResultSet(task, dbConfig.Charset, rows, meta)
+	if err != nil {
+		return response, err
+	}
+
+	// There's no insert ID for a RETURNING statement - the returned rows carry any generated keys
+	rowsAffected := countResultRows(returning)
+	response = newDbExecResult(nil, &rowsAffected)
+	response.Returning = returning
+
+	return response, rows.Err()
+}
+
+/*
+Open a DB connection and list the schemas and tables visible to it, along with their columns
+*/
+func processDbIntrospect(ctx context.Context, task Task) ([]DbTable, error) {
+
+	dbConfig, err := getTaskDbConfig(task)
+	if err != nil {
+		return nil, err
+	}
+
+	query, ok := introspectQueries[dbConfig.Type]
+	if !ok {
+		return nil, fmt.Errorf("Introspection is not supported for database type: %s", dbConfig.Type)
+	}
+
+	fmt.Println("Introspecting database...")
+
+	db, err := initDbQueryConnection(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := queryDb(ctx, db, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := []DbTable{}
+	for rows.Next() {
+		table := DbTable{Columns: []DbColumn{}}
+		if err := rows.Scan(&table.Schema, &table.Name, &table.Type); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tables, introspectColumns(ctx, db, dbConfig.Type, tables)
+}
+
+/*
+Fill in the columns of introspected tables
+*/
+func introspectColumns(ctx context.Context, db *sql.DB, dbType string, tables []DbTable) error {
+
+	query, ok := introspectColumnQueries[dbType]
+	if !ok {
+		return nil
+	}
+
+	tableIndexes := make(map[string]int, len(tables))
+	for i, table := range tables {
+		tableIndexes[table.Schema+"."+table.Name] = i
+	}
+
+	rows, err := queryDb(ctx, db, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schema, tableName, nullable string
+		var column DbColumn
+		var columnDefault sql.NullString
+		if err := rows.Scan(&schema, &tableName, &column.Name, &column.Type, &nullable, &columnDefault); err != nil {
+			return err
+		}
+
+		i, ok := tableIndexes[schema+"."+tableName]
+		if !ok {
+			continue
+		}
+
+		column.Type = strings.ToUpper(column.Type)
+		column.Nullable = strings.EqualFold(nullable, "YES")
+		if columnDefault.Valid {
+			column.Default = &columnDefault.String
+		}
+		tables[i].Columns = append(tables[i].Columns, column)
+	}
+
+	return rows.Err()
+}
+
+/*
+Open a DB connection and report the server version, current database and query round trip time
+*/
+func processDbDiagnostic(ctx context.Context, task Task) (DbDiagnostic, error) {
+
+	var diagnostic DbDiagnostic
+
+	dbConfig, err := getTaskDbConfig(task)
+	if err != nil {
+		return diagnostic, err
+	}
+
+	query, ok := diagnosticQueries[dbConfig.Type]
+	if !ok {
+		return diagnostic, fmt.Errorf("Diagnostics are not supported for database type: %s", dbConfig.Type)
+	}
+
+	fmt.Println("Running database diagnostic...")
+
+	db, err := initDbQueryConnection(ctx, task)
+	if err != nil {
+		return diagnostic, err
+	}
+
+	// The current database is NULL when the DSN doesn't name one
+	var version, database sql.NullString
+
+	started := time.Now()
+	rows, err := queryDb(ctx, db, query)
+	if err != nil {
+		return diagnostic, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		if err := rows.Scan(&version, &database); err != nil {
+			return diagnostic, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return diagnostic, err
+	}
+
+	diagnostic.LatencyMs = float64(time.Since(started).Microseconds()) / 1000
+	diagnostic.Version = version.String
+	diagnostic.Database = database.String
+
+	return diagnostic, nil
+}
+
+/*
+Wrap an error returned by a database driver, extracting the native error number
+e.g. 1062 (duplicate entry) or 1213 (deadlock), and the SQLSTATE, where the driver provides them.
+Driver errors are found even when wrapped by another error.
+*/
+func newDbError(err error) *TaskError {
+	if taskErr, ok := err.(*TaskError); ok {
+		return taskErr
+	}
+
+	taskErr := &TaskError{
+		Status: http.StatusInternalServerError,
+		Err:    fmt.Errorf("Database error: %s", err),
+	}
+
+	var mysqlErr *mysql.MySQLError
+	var mssqlErr mssql.Error
+	switch {
+	case errors.As(err, &mysqlErr):
+		taskErr.DbErrorCode = strconv.Itoa(int(mysqlErr.Number))
+		if mysqlErr.SQLState != [5]byte{} {
+			taskErr.DbSqlState = string(mysqlErr.SQLState[:])
+		}
+	case errors.As(err, &mssqlErr):
+		// SQL Server reports no SQLSTATE, only its error number
+		taskErr.DbErrorCode = strconv.Itoa(int(mssqlErr.Number))
+	}
+
+	return taskErr
+}
+
+/*
+Parse HTTP request body for a task - should JSON decode the task and process it based on it's type
+*/
+func processTaskRequest(r *http.Request) (task Task, response interface{}, meta ResponseMeta, err error) {
+
+	meta = ResponseMeta{}
+
+	ctx, span := tracer.Start(r.Context(), "processTaskRequest")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	// Read the contents of the request body
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		return task, response, meta, err
+	}
+	if err := r.Body.Close(); err != nil {
+		return task, response, meta, err
+	}
+
+	task, response, meta, err = processTask(ctx, body)
+
+	return task, response, meta, err
+}
+
+/*
+Decode a JSON encoded task and process it based on its type. The task's database calls run in the parent
+context, so they end if the client disconnects or the request times out, as well as when the task is cancelled.
+*/
+func processTask(parent context.Context, body []byte) (task Task, response interface{}, meta ResponseMeta, err error) {
+
+	meta = ResponseMeta{}
+
+	// Attempt to JSON decode the request body into a Task struct
+	task, err = parseTask(body)
+	if _, ok := err.(*TaskError); ok {
+		return task, response, meta, err
+	}
+	if err != nil {
+		return task, response, meta, fmt.Errorf("Unable to parse JSON request body: %s", err)
+	}
+
+	if err := checkTaskTypeEnabled(task.Type); err != nil {
+		return task, response, meta, err
+	}
+
+	// A retried task with the same idempotency key gets the first run's result, rather than running twice
+	if task.IdempotencyKey != "" {
+		fingerprint := idempotencyFingerprint(task)
+		result, replayed, claimErr := claimIdempotencyKey(task.IdempotencyKey, fingerprint)
+		if claimErr != nil {
+			return task, response, meta, claimErr
+		}
+		if replayed {
+			meta["idempotent_replay"] = true
+			return task, result, meta, nil
+		}
+		defer func() {
+			completeIdempotencyKey(task.IdempotencyKey, fingerprint, response, err)
+		}()
+	}
+
+	// Track the task while it runs, so it can be cancelled through the /cancel endpoint. Database calls join
+	// the request's trace and any progress stream, and a client disconnect cancels them.
+	ctx, done := trackTask(parent, task.Id)
+	defer done()
+	setTaskSpanAttributes(trace.SpanFromContext(ctx), task)
+
+	started := time.Now()
+	logVerboseStart(task)
+
+	// Tasks run on the worker pool, so a burst of requests waits its turn rather than all running at once
+	response, err = runQueued(ctx, func(ctx context.Context) (interface{}, error) {
+		logVerbose(task, "picked up by a worker after %dms in the queue", time.Since(started).Milliseconds())
+		return runTask(ctx, task, meta)
+	})
+
+	if err != nil && ctx.Err() == context.Canceled {
+		err = cancelledTaskError(parent, task.Id)
+	}
+	logVerboseEnd(task, started, response, meta, err)
+
+	return task, response, meta, err
+}
+
+/*
+Run a task against its database, based on its type
+*/
+func runTask(ctx context.Context, task Task, meta ResponseMeta) (response interface{}, err error) {
+
+	release, err := acquireDbSlot(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	switch task.Type {
+	case TASK_TYPE_DB_MYSQL_QUERY, TASK_TYPE_DB_MSSQL_QUERY, TASK_TYPE_DB_MARIA_QUERY, TASK_TYPE_DB_ORACLE_QUERY, TASK_TYPE_DB_SQLITE_QUERY:
+		response, err = processDbQuery(ctx, task, meta)
+		fmt.Println(response)
+		if err != nil {
+			err = newDbError(err)
+		} else if task.OutputFilePath != "" {
+			response, err = exportResult(task.OutputFilePath, response)
+		}
+	case TASK_TYPE_DB_MYSQL_EXEC, TASK_TYPE_DB_MSSQL_EXEC, TASK_TYPE_DB_ORACLE_EXEC:
+		response, err = processDbExec(ctx, task, meta)
+		if err != nil {
+			err = newDbError(err)
+		}
+	case TASK_TYPE_DB_MARIA_EXEC:
+		if returningPattern.MatchString(task.Payload) {
+			response, err = processDbExecReturning(ctx, task, meta)
+		} else {
+			response, err = processDbExec(ctx, task, meta)
+		}
+		if err != nil {
+			err = newDbError(err)
+		}
+	case TASK_TYPE_DB_INTROSPECT:
+		response, err = processDbIntrospect(ctx, task)
+		if err != nil {
+			err = newDbError(err)
+		}
+	case TASK_TYPE_DB_CALLPROC:
+		response, err = processDbCallProc(ctx, task, meta)
+		if err != nil {
+			err = newDbError(err)
+		}
+	case TASK_TYPE_DB_DIAGNOSTIC:
+		response, err = processDbDiagnostic(ctx, task)
+		if err != nil {
+			err = newDbError(err)
+		}
+	case TASK_TYPE_DB_BULK_INSERT:
+		response, err = processDbBulkInsert(ctx, task)
+		if err != nil {
+			err = newDbError(err)
+		}
+	case TASK_TYPE_DB_SUBSCRIBE:
+		return nil, &TaskError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("%s tasks stream their results, and must be made through /subscribe", task.Type),
+		}
+	default:
+		return nil, fmt.Errorf("Unknown task type: %s", task.Type)
+	}
+
+	return response, err
+}
+
+/*
+Explain why a task's context was cancelled - the client requesting it went away, or it was cancelled
+through the /cancel endpoint or at shutdown
+*/
+func cancelledTaskError(parent context.Context, id string) error {
+	if parent.Err() == context.Canceled {
+		svcLogger.Warningf("client_disconnected: task %s abandoned, its database calls cancelled", id)
+		return newClientDisconnectedError(id)
+	}
+
+	return newCancelledError(id)
+}
+
+/*
+Get the HTTP basic auth headers and check against the configured username and API key
+*/
+func checkAuth(w http.ResponseWriter, r *http.Request) bool {
+	s := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(s) != 2 {
+		return false
+	}
+
+	b, err := base64.StdEncoding.DecodeString(s[1])
+	if err != nil {
+		return false
+	}
+
+	pair := strings.SplitN(string(b), ":", 2)
+	if len(pair) != 2 {
+		return false
+	}
+
+	// An empty key must never match, or a blank password would be accepted while no key is configured
+	return getConfig().ApiKey != "" && pair[0] == AUTH_USER && pair[1] == getConfig().ApiKey
+}
+
+/*
+Check whether a request may be handled without credentials while no API key is configured. The health check
+is open so monitoring can see the connector is waiting for a key, and the config endpoint is open to the
+connector's own host so an operator there can set one.
+*/
+func allowWithoutApiKey(r *http.Request) bool {
+	if r.URL.Path == "/health" {
+		return true
+	}
+
+	// A request relayed by a proxy on this host isn't from this host
+	if r.Header.Get("X-Forwarded-For") != "" || r.Header.Get("X-Real-IP") != "" {
+		return false
+	}
+
+	return r.URL.Path == "/admin/config" && isLoopbackAddr(r.RemoteAddr)
+}
+
+/*
+Wrapper function to handle HTTP requests, checking HTTP basic authorisation credentials
+*/
+func handleAuthMiddleware(w http.ResponseWriter, r *http.Request, handler func(http.ResponseWriter, *http.Request)) {
+	ip := clientIP(r)
+
+	// Refuse clients that have repeatedly failed to authenticate, regardless of their credentials
+	if locked, remaining := authLockout(ip); locked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("429 Too Many Requests\n"))
+		return
+	}
+
+	if getConfig().ApiKey == "" {
+		if allowWithoutApiKey(r) {
+			handler(w, r)
+			return
+		}
+
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("401 Unauthorized - no API key is configured on this connector\n"))
+		return
+	}
+
+	if checkAuth(w, r) {
+		recordAuthSuccess(ip)
+		handler(w, r)
+		return
+	}
+
+	// A request without credentials is usually a browser about to prompt for them, so isn't counted
+	if r.Header.Get("Authorization") != "" {
+		recordAuthFailure(ip)
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="MY REALM"`)
+	w.WriteHeader(401)
+	w.Write([]byte("401 Unauthorized\n"))
+}
+
+/*
+Handle an HTTP request to the / URL - display a success message
+*/
+func handleRoot(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, r, http.StatusOK, JsonResponse{
+		Type: "success",
+		Body: ConnectorStatus{
+			Message:          "Digistorm Connector Online",
+			Version:          version,
+			UptimeSeconds:    int64(time.Since(startedAt).Seconds()),
+			DbPools:          countDbPools(),
+			ApiKeyConfigured: getConfig().ApiKey != "",
+		},
+	})
+}
+
+/*
+Handle an HTTP request to the /task URL - should contain a JSON encoded task in the request body
+*/
+func handleTask(w http.ResponseWriter, r *http.Request) {
+
+	// A panic in a driver or while mapping results shouldn't take the connection down without a response
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			svcLogger.Errorf("Panic while processing task: %v\n%s", recovered, debug.Stack())
+			writeResponse(w, r, http.StatusInternalServerError, JsonResponse{
+				Type: "error",
+				Body: fmt.Sprintf("Internal error: %v", recovered),
+				Code: "panic",
+			})
+		}
+	}()
+
+	if rejectForMaintenance(w, r) {
+		return
+	}
+
+	ctx, span := startRequestSpan(r.Context(), propagation.HeaderCarrier(r.Header), "handleTask")
+	r = r.WithContext(ctx)
+
+	started := time.Now()
+	task, rawResponse, meta, err := processTaskRequest(r)
+	encoded := rawResponse
+	if err == nil {
+		encoded, err = encodeResult(rawResponse, task.OutputFormat == OUTPUT_FORMAT_MSGPACK)
+	}
+	writeAuditEntry(task, clientIP(r), rawResponse, started, err)
+	recordTaskMetrics(task, started, err)
+	endSpan(span, err)
+
+	// The response has the same shape whichever encoding the task asks for
+	write := writeJson
+	if task.OutputFormat == OUTPUT_FORMAT_MSGPACK {
+		write = writeMsgpack
+	}
+
+	if err != nil {
+		status, response := newErrorResponse(err)
+
+		if !useEnvelope(task) {
+			write(w, r, status, RawErrorResponse{
+				Error:       err.Error(),
+				Code:        response.Code,
+				DbErrorCode: response.DbErrorCode,
+				DbSqlState:  response.DbSqlState,
+				Errors:      response.Errors,
+			})
+			return
+		}
+
+		write(w, r, status, response)
+		return
+	}
+
+	if !useEnvelope(task) {
+		write(w, r, http.StatusOK, encoded)
+		return
+	}
+
+	write(w, r, http.StatusOK, JsonResponse{
+		Type: "success",
+		Body: encoded,
+		Meta: meta,
+	})
+
+}
+
+/*
+Encode a result for sending, refusing it if the encoding exceeds `MaxResponseBytes` - a single huge TEXT/BLOB
+column can make a response far larger than its row count suggests. The result is only encoded once - the
+encoding is returned to be written as it is, so a big result isn't encoded again to send it.
+*/
+func encodeResult(response interface{}, asMsgpack bool) (interface{}, error) {
+	if getConfig().MaxResponseBytes <= 0 {
+		return response, nil
+	}
+
+	var size int
+	var encoded interface{}
+	if asMsgpack {
+		data, err := marshalMsgpack(response)
+		if err != nil {
+			return nil, err
+		}
+		size, encoded = len(data), data
+	} else {
+		data, err := json.Marshal(response)
+		if err != nil {
+			return nil, err
+		}
+		size, encoded = len(data), json.RawMessage(data)
+	}
+
+	if int64(size) > getConfig().MaxResponseBytes {
+		return nil, &TaskError{
+			Status: http.StatusInternalServerError,
+			Code:   "response_too_large",
+			Err:    fmt.Errorf("Response too large: result is %d bytes, which exceeds max_response_bytes (%d)", size, getConfig().MaxResponseBytes),
+		}
+	}
+
+	return encoded, nil
+}
+
+/*
+Build the response for a failed task, taking the status and error codes from a TaskError
+*/
+func newErrorResponse(err error) (int, JsonResponse) {
+	status := http.StatusInternalServerError
+	response := JsonResponse{
+		Type: "error",
+		Body: fmt.Sprintf("%s", err),
+	}
+	if taskErr, ok := err.(*TaskError); ok {
+		status = taskErr.Status
+		response.Code = taskErr.Code
+		response.DbErrorCode = taskErr.DbErrorCode
+		response.DbSqlState = taskErr.DbSqlState
+		response.Errors = taskErr.Errors
+	}
+
+	return status, response
+}
+
+/*
+Check whether a task's response should be wrapped in a JsonResponse, or written as the bare result
+*/
+func useEnvelope(task Task) bool {
+	if task.Envelope != nil {
+		return *task.Envelope
+	}
+
+	return !getConfig().RawResponses
+}
+
+/*
+Write a JSON response
+*/
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, response JsonResponse) {
+	writeJson(w, r, status, response)
+}
+
+/*
+Write any value as JSON, indented for readability if the request has `?pretty=1` or pretty responses are configured
+*/
+func writeJson(w http.ResponseWriter, r *http.Request, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	if getConfig().PrettyResponses || r.URL.Query().Get("pretty") == "1" {
+		encoder.SetIndent("", "  ")
+	}
+	err := encoder.Encode(response)
+	errCheck(err)
 }
 
 /*
 Start listening on the configured address
 */
 func startServer() {
-	serverAddress := fmt.Sprintf("%s:%s", config.Host, config.Port)
+	serverAddress := net.JoinHostPort(getConfig().Host, getConfig().Port)
 
-	certPath, err := getAssetPath("server.cert.pem")
-	errCheckFatal(err)
-	keyPath, err := getAssetPath("server.key.pem")
+	cert, err := loadServerCertificate(getConfig().Host)
+	if err != nil {
+		log.Fatal("Error: Couldn't create https certs.")
+	}
+	setServerCertificate(cert)
+
+	hostCerts, err = loadHostCertificates(getConfig().Certificates)
 	errCheckFatal(err)
 
-	// Check if the cert files are available.
-	err = httpscerts.Check(certPath, keyPath)
-	// If they are not available, generate new ones.
-	if err != nil {
-		err = httpscerts.Generate(certPath, keyPath, serverAddress)
-		if err != nil {
-			log.Fatal("Error: Couldn't create https certs.")
+	if len(getConfig().ClientCaPaths) > 0 {
+		errCheckFatal(reloadClientCaPool())
+	}
+
+	errCheckFatal(rotateSessionTicketKeys(configSeconds(getConfig().SessionTicketRotationSeconds, SESSION_TICKET_ROTATION)))
+
+	startTaskWorkers()
+
+	// Quick requests get a short timeout, while tasks may legitimately take minutes to run a report query
+	requestTimeout := configSeconds(getConfig().RequestTimeoutSeconds, REQUEST_TIMEOUT)
+	taskTimeout := configSeconds(getConfig().TaskTimeoutSeconds, TASK_TIMEOUT)
+
+	setMaintenance(getConfig().Maintenance)
+
+	if getConfig().KeepAliveIntervalSeconds > 0 {
+		go keepPoolsAlive(time.Duration(getConfig().KeepAliveIntervalSeconds) * time.Second)
+	}
+
+	handleRoute("/", requestTimeout, handleRoot)
+	handleRoute("/health", requestTimeout, handleHealth)
+	handleRoute("/metrics", requestTimeout, handleMetrics)
+	handleRoute("/task", taskTimeout, handleTask)
+	handleRoute("/task/progress", 0, handleTaskProgress)
+	handleRoute("/cancel/", requestTimeout, handleCancel)
+	handleRoute("/admin/config", requestTimeout, handleAdminConfig)
+	handleRoute("/admin/cache/clear", requestTimeout, handleClearCache)
+	handleRoute("/admin/renew-cert", requestTimeout, handleRenewCert)
+	handleRoute("/admin/maintenance", requestTimeout, handleMaintenance)
+	handleRoute("/admin/test-connection", requestTimeout, handleTestConnection)
+	handleRoute("/subscribe", 0, handleSubscribe)
+	handleRoute("/ws", 0, handleWebSocket)
+
+	listenerConfigs := getConfig().Listeners
+	if len(listenerConfigs) == 0 {
+		listenerConfigs = []ListenerConfig{{Addr: serverAddress, TLS: true}}
+	}
+
+	// Every listener serves the same routes, so the connector mustn't run on with only some of them - the first
+	// to stop unexpectedly stops the rest, and the connector exits for the service manager to restart it
+	serveErrors := make(chan error, len(listenerConfigs))
+	for _, listenerConfig := range listenerConfigs {
+		if !listenerConfig.TLS && !isLoopbackAddr(listenerConfig.Addr) {
+			errCheckFatal(fmt.Errorf("Plaintext listener %s must be bound to a loopback address", listenerConfig.Addr))
+		}
+
+		// Without a global write timeout, idle and slow clients are reaped by the read and idle timeouts instead
+		server := &http.Server{
+			Addr:              listenerConfig.Addr,
+			ReadHeaderTimeout: requestTimeout,
+			ReadTimeout:       requestTimeout,
+			IdleTimeout:       IDLE_TIMEOUT * time.Second,
+			ConnState:         trackConnState,
+		}
+		if listenerConfig.TLS {
+			server.TLSConfig = &tls.Config{
+				GetCertificate: getServerCertificate,
+				WrapSession:    sessionTicketConfig.EncryptTicket,
+				UnwrapSession:  sessionTicketConfig.DecryptTicket,
+			}
+			requireClientCertificates(server.TLSConfig)
 		}
+
+		listener, err := listenWithRetry(listenerConfig.Addr)
+		errCheckFatal(err)
+		listener = withKeepAlive(listener)
+
+		serversLock.Lock()
+		servers = append(servers, server)
+		serversLock.Unlock()
+
+		go func(server *http.Server, listener net.Listener, useTLS bool) {
+			if useTLS {
+				fmt.Println(fmt.Sprintf("Starting server on address: %s", server.Addr))
+				serveErrors <- server.ServeTLS(listener, "", "")
+			} else {
+				fmt.Println(fmt.Sprintf("Starting plaintext server on address: %s", server.Addr))
+				serveErrors <- server.Serve(listener)
+			}
+		}(server, listener, listenerConfig.TLS)
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		handleAuthMiddleware(w, r, handleRoot)
-	})
-	http.HandleFunc("/task", func(w http.ResponseWriter, r *http.Request) {
-		handleAuthMiddleware(w, r, handleTask)
+	err = <-serveErrors
+	if err != http.ErrServerClosed {
+		svcLogger.Errorf("A listener stopped, stopping the connector: %s", err)
+		stopServers()
+		errCheckFatal(err)
+	}
+}
+
+/*
+Check whether a listen address is bound to the loopback interface, so is only reachable from this machine
+*/
+func isLoopbackAddr(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+/*
+Stop every listener together, letting in-flight requests finish for up to SHUTDOWN_TIMEOUT. Tasks still
+running after that are cancelled, so their queries don't carry on against the database once the
+connector has stopped.
+*/
+func stopServers() {
+	serversLock.Lock()
+	defer serversLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT*time.Second)
+	defer cancel()
+
+	for _, server := range servers {
+		errCheck(server.Shutdown(ctx))
+	}
+	servers = nil
+
+	if cancelled := cancelAllTasks(); cancelled > 0 {
+		svcLogger.Warningf("Cancelled %d tasks still running at shutdown", cancelled)
+	}
+}
+
+/*
+Register an authenticated handler for a URL pattern, responding with a 503 if it runs longer than the timeout
+*/
+func handleRoute(pattern string, timeout time.Duration, handler func(http.ResponseWriter, *http.Request)) {
+	authHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleAuthMiddleware(w, r, handler)
 	})
-	fmt.Println(fmt.Sprintf("Starting server on address: %s", serverAddress))
-	http.ListenAndServeTLS(serverAddress, certPath, keyPath, nil)
+
+	// Streaming routes run until the client disconnects, and can't be buffered by a TimeoutHandler
+	if timeout <= 0 {
+		http.Handle(pattern, accessLogHandler(corsHandler(authHandler)))
+		return
+	}
+
+	http.Handle(pattern, accessLogHandler(corsHandler(http.TimeoutHandler(authHandler, timeout, `{"type": "error", "body": "Request timed out"}`))))
+}
+
+/*
+Bind the server address, retrying with exponential backoff - during a service restart
+the old process may not have released the port yet
+*/
+func listenWithRetry(address string) (net.Listener, error) {
+	attempts := getConfig().BindRetryAttempts
+	if attempts <= 0 {
+		attempts = BIND_RETRY_ATTEMPTS
+	}
+	delay := time.Duration(getConfig().BindRetryDelaySeconds) * time.Second
+	if delay <= 0 {
+		delay = BIND_RETRY_DELAY * time.Second
+	}
+
+	for attempt := 1; ; attempt++ {
+		listener, err := net.Listen("tcp", address)
+		if err == nil || attempt >= attempts {
+			return listener, err
+		}
+
+		svcLogger.Warningf("Unable to bind %s (attempt %d of %d), retrying in %s: %s", address, attempt, attempts, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
 }
 
 func (p *program) Start(s service.Service) error {
@@ -457,13 +2003,20 @@ func (p *program) Start(s service.Service) error {
 }
 func (p *program) run() error {
 	svcLogger.Infof("Connector running on platform: %v.", service.Platform())
-	svcLogger.Infof("Config: %v", config)
+	svcLogger.Infof("Config: %v", redactedConfig())
 
-	// By this point, there should be an API key in the config - show the user an error if it hasn't been provided
-	if len(config.ApiKey) == 0 {
-		errCheckFatal(errors.New("API key must be specified e.g. 'connector.exe -key=ABC123'"))
+	// By this point, there should be an API key in the config. Without one, the connector starts without running
+	// tasks until a key is set, so a service manager doesn't keep restarting it.
+	if len(getConfig().ApiKey) == 0 {
+		if strict {
+			errCheckFatal(errors.New("API key must be specified e.g. 'connector.exe -key=ABC123'"))
+		}
+		svcLogger.Warning("No API key configured - tasks will be refused until one is set with 'connector.exe -key=ABC123' or a PATCH to /admin/config from this host")
 	}
 
+	errCheck(initTracing())
+
+	startReadinessGate()
 	startServer()
 
 	return nil
@@ -471,6 +2024,8 @@ func (p *program) run() error {
 func (p *program) Stop(s service.Service) error {
 	// Any work in Stop should be quick, usually a few seconds at most.
 	svcLogger.Info("Connector stopping")
+	stopServers()
+	shutdownTracing()
 	close(p.exit)
 	return nil
 }
@@ -488,11 +2043,12 @@ func errCheckFatal(err error) {
 }
 
 // Service setup.
-//   Define service config.
-//   Create the service.
-//   Setup the logger.
-//   Handle service controls (optional).
-//   Run the service.
+//
+//	Define service config.
+//	Create the service.
+//	Setup the logger.
+//	Handle service controls (optional).
+//	Run the service.
 func main() {
 
 	svcConfig := &service.Config{
@@ -524,6 +2080,16 @@ func main() {
 	err = processConfig()
 	errCheckFatal(err)
 
+	if initCa {
+		errCheckFatal(initCertificateAuthority())
+		return
+	}
+
+	if printConf {
+		errCheckFatal(printEffectiveConfig())
+		return
+	}
+
 	if len(svcFlag) != 0 {
 		err := service.Control(s, svcFlag)
 		if err != nil {
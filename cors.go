@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	CORS_ALLOW_METHODS = "GET, POST, PATCH, OPTIONS"
+	CORS_ALLOW_HEADERS = "Authorization, Content-Type, Traceparent"
+	CORS_MAX_AGE       = 600 // Seconds browsers may cache a preflight response
+)
+
+/*
+Wrap a handler to apply the CORS policy for browser based tools. With no `allowed_origins` configured,
+requests pass through untouched, as they always have. Otherwise, requests from listed origins get the
+Access-Control headers browsers need, preflight requests are answered without authentication, and
+requests from any other origin are refused.
+*/
+func corsHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(getConfig().AllowedOrigins) == 0 || origin == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		w.Header().Add("Vary", "Origin")
+		if !isAllowedOrigin(origin) {
+			svcLogger.Warningf("Refusing request from origin %s, which isn't in allowed_origins", origin)
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 Forbidden - origin not allowed\n"))
+			return
+		}
+
+		// Credentials are needed for basic auth, so the origin is echoed back rather than "*"
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", CORS_ALLOW_METHODS)
+			w.Header().Set("Access-Control-Allow-Headers", CORS_ALLOW_HEADERS)
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(CORS_MAX_AGE))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+/*
+Check whether an origin is one of the configured `allowed_origins`, where "*" allows any origin
+*/
+func isAllowedOrigin(origin string) bool {
+	for _, allowed := range getConfig().AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimRight(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	return false
+}
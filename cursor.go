@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	CURSOR_PAGE_ROWS = 1000 // Rows in each page of a cursor paged query, unless the task gives a `cursor_limit`
+)
+
+/*
+Wrap a query to return one page of its rows, in order of the task's cursor column, starting after the
+task's cursor value e.g. "SELECT * FROM (query) cursor_page WHERE id > ? ORDER BY id LIMIT 1000".
+The cursor value is bound after the query's own params.
+*/
+func cursorStatement(task Task, dbType string, query string, args []interface{}) (string, []interface{}, error) {
+	column := task.CursorColumn
+	limit := task.CursorLimit
+	if limit <= 0 {
+		limit = CURSOR_PAGE_ROWS
+	}
+
+	where := ""
+	value, err := decodeCursorValue(task.CursorValue)
+	if err != nil {
+		return "", nil, err
+	}
+	if value != nil {
+		args = append(args, value)
+		where = fmt.Sprintf(" WHERE %s > %s", column, placeholder(dbType, len(args)))
+	}
+
+	// Trailing semicolons would end the statement inside the subquery
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+
+	switch dbType {
+	case "mssql":
+		return fmt.Sprintf("SELECT TOP (%d) * FROM (%s) AS cursor_page%s ORDER BY %s", limit, query, where, column), args, nil
+	case "oracle":
+		return fmt.Sprintf("SELECT * FROM (%s) cursor_page%s ORDER BY %s FETCH FIRST %d ROWS ONLY", query, where, column, limit), args, nil
+	}
+
+	return fmt.Sprintf("SELECT * FROM (%s) AS cursor_page%s ORDER BY %s LIMIT %d", query, where, column, limit), args, nil
+}
+
+/*
+Decode a task's cursor value, with numbers converted as params are. Returns nil for the first page.
+*/
+func decodeCursorValue(raw json.RawMessage) (interface{}, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, nil
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("cursor_value is invalid: %s", err)
+	}
+
+	return convertNumber(value), nil
+}
+
+/*
+Record the cursor for the page after a result set in the response's meta - the cursor column's value in
+the last row, and whether a full page came back, meaning there may be more rows to fetch
+*/
+func setNextCursor(task Task, columns []string, rows []map[string]interface{}, meta ResponseMeta) {
+	limit := task.CursorLimit
+	if limit <= 0 {
+		limit = CURSOR_PAGE_ROWS
+	}
+
+	meta["has_more"] = len(rows) >= limit
+	meta["next_cursor"] = nil
+	if len(rows) == 0 {
+		return
+	}
+
+	for _, column := range columns {
+		if strings.EqualFold(column, task.CursorColumn) {
+			meta["next_cursor"] = rows[len(rows)-1][column]
+			return
+		}
+	}
+
+	addWarning(meta, fmt.Sprintf("cursor_column: column %q is not in the result", task.CursorColumn))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	STATEMENT_CATEGORY_DDL = "ddl"
+)
+
+var (
+	// Matches the start of a schema change e.g. "CREATE TABLE dbo.users", "DROP INDEX IF EXISTS idx_email",
+	// "CREATE OR REPLACE VIEW v_students", "TRUNCATE TABLE logs" or "RENAME TABLE a TO b"
+	ddlPattern = regexp.MustCompile("(?is)^\\s*(CREATE|ALTER|DROP|TRUNCATE|RENAME)\\s+(?:OR\\s+(?:REPLACE|ALTER)\\s+)?" +
+		"(?:(?:TEMPORARY|TEMP|GLOBAL|LOCAL|UNIQUE|CLUSTERED|NONCLUSTERED|MATERIALIZED|FULLTEXT|SPATIAL)\\s+)*" +
+		"(\\w+)(?:\\s+(?:IF\\s+(?:NOT\\s+)?EXISTS\\s+)?([\\w.\\[\\]\"`$#]+))?")
+)
+
+/*
+The schema object a DDL statement changes
+*/
+type DbObject struct {
+	Action string `json:"action"`         // e.g. "CREATE", "ALTER", "DROP"
+	Type   string `json:"type"`           // e.g. "TABLE", "INDEX", "VIEW"
+	Name   string `json:"name,omitempty"` // As written in the statement, including any schema
+}
+
+/*
+Describe the object a DDL statement changes, or return nil if the statement isn't DDL
+*/
+func parseDdlStatement(query string) *DbObject {
+	match := ddlPattern.FindStringSubmatch(query)
+	if match == nil {
+		return nil
+	}
+
+	object := &DbObject{
+		Action: strings.ToUpper(match[1]),
+		Type:   strings.ToUpper(match[2]),
+		Name:   match[3],
+	}
+
+	// TRUNCATE may leave out TABLE e.g. "TRUNCATE logs", in which case the name was read as the type
+	if object.Action == "TRUNCATE" && object.Type != "TABLE" && object.Name == "" {
+		object.Type, object.Name = "TABLE", match[2]
+	}
+
+	return object
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/markokeeffe/mapquery"
+	"strings"
+)
+
+/*
+Get the plan the database would use for a query, without running it. Each engine has its own way of asking:
+MySQL/MariaDB `EXPLAIN`, SQLite `EXPLAIN QUERY PLAN`, SQL Server `SET SHOWPLAN_ALL` for the session, and
+Oracle `EXPLAIN PLAN` into the session's plan table, read back with DBMS_XPLAN. The plan is returned as
+rows, one result set per statement planned.
+*/
+func explainQuery(ctx context.Context, db *sql.DB, dbType string, query string, args []interface{}) ([]interface{}, error) {
+	mapPlan := func(rows *sql.Rows) (interface{}, error) {
+		return mapquery.MapRows(rows)
+	}
+
+	switch dbType {
+	case "mssql", "oracle":
+		// The plan is a property of the session, so everything must run on the same connection
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		if dbType == "oracle" {
+			if _, err := conn.ExecContext(ctx, "EXPLAIN PLAN FOR "+strings.TrimRight(strings.TrimSpace(query), ";"), args...); err != nil {
+				return nil, err
+			}
+			rows, err := conn.QueryContext(ctx, "SELECT PLAN_TABLE_OUTPUT FROM TABLE(DBMS_XPLAN.DISPLAY())")
+			if err != nil {
+				return nil, err
+			}
+			defer rows.Close()
+			return mapResultSets(rows, mapPlan)
+		}
+
+		if _, err := conn.ExecContext(ctx, "SET SHOWPLAN_ALL ON"); err != nil {
+			return nil, err
+		}
+
+		rows, err := conn.QueryContext(ctx, query, args...)
+		var resultSets []interface{}
+		if err == nil {
+			resultSets, err = mapResultSets(rows, mapPlan)
+			rows.Close()
+		}
+
+		// A connection left showing plans would return a plan instead of rows to the next task to use it
+		if _, offErr := conn.ExecContext(ctx, "SET SHOWPLAN_ALL OFF"); offErr != nil {
+			svcLogger.Warningf("Unable to turn SHOWPLAN_ALL off, discarding the connection: %s", offErr)
+			conn.Raw(func(interface{}) error {
+				return driver.ErrBadConn
+			})
+		}
+
+		return resultSets, err
+	case "sqlite":
+		query = "EXPLAIN QUERY PLAN " + query
+	default:
+		query = "EXPLAIN " + query
+	}
+
+	rows, err := queryDb(ctx, db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return mapResultSets(rows, mapPlan)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+The response to a query task whose result was written to a file instead of returned
+*/
+type DbExportResult struct {
+	Path  string `json:"path"`
+	Rows  int64  `json:"rows"`
+	Bytes int64  `json:"bytes"`
+}
+
+/*
+Check a task's output file is inside one of the configured `export_paths` directories, returning the
+cleaned absolute path to write to. With no export paths configured, nothing may be written.
+*/
+func checkExportPath(path string) (string, error) {
+	if len(getConfig().ExportPaths) == 0 {
+		return "", fmt.Errorf("writing results to files is not enabled on this connector")
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	// Resolve links in the directory, so a link inside an allowed directory can't point the file outside it
+	dir, err := filepath.EvalSymlinks(filepath.Dir(absPath))
+	if err != nil {
+		return "", fmt.Errorf("directory %s can't be used: %s", filepath.Dir(absPath), err)
+	}
+	absPath = filepath.Join(dir, filepath.Base(absPath))
+
+	for _, exportPath := range getConfig().ExportPaths {
+		allowed, err := filepath.Abs(exportPath)
+		if err != nil {
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(allowed); err == nil {
+			allowed = resolved
+		}
+		if rel, err := filepath.Rel(allowed, absPath); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			return absPath, nil
+		}
+	}
+
+	return "", fmt.Errorf("%s is not inside one of the connector's export_paths", path)
+}
+
+/*
+Write a query result to its output file as JSON, laid out in the task's output format. The file is written
+beside its final path and renamed into place, so a reader never sees a partly written export.
+*/
+func exportResult(path string, result interface{}) (DbExportResult, error) {
+	var response DbExportResult
+
+	absPath, err := checkExportPath(path)
+	if err != nil {
+		return response, err
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return response, err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(absPath), "."+filepath.Base(absPath)+".*")
+	if err != nil {
+		return response, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return response, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return response, err
+	}
+	if err := os.Rename(tmpFile.Name(), absPath); err != nil {
+		return response, err
+	}
+
+	svcLogger.Infof("Exported %d bytes of query results to %s", len(data), absPath)
+
+	return DbExportResult{
+		Path:  absPath,
+		Rows:  countResultRows(result),
+		Bytes: int64(len(data)),
+	}, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	IDEMPOTENCY_TTL = 86400 // Seconds a completed task's result is kept for repeats of its idempotency key
+)
+
+var (
+	idempotentTasks     = make(map[string]*idempotentTask) // Tasks run with an idempotency key, keyed by that key
+	idempotentTasksLock sync.Mutex
+)
+
+/*
+A task run with an idempotency key - in progress until it has a result, then kept until it expires
+*/
+type idempotentTask struct {
+	fingerprint string // Hash of what the task runs, so a different task reusing the key isn't given this result
+	result      interface{}
+	complete    bool
+	expires     time.Time
+}
+
+/*
+Hash what a task runs and where - its type, database, statement and values - so a repeat of an idempotency
+key can be checked to be the same task
+*/
+func idempotencyFingerprint(task Task) string {
+	data, _ := json.Marshal([]interface{}{
+		task.Type,
+		task.DbName,
+		task.RawConfig,
+		task.Payload,
+		task.Params,
+		task.ParamTypes,
+		task.ProcParams,
+		task.Columns,
+		task.Rows,
+		task.SeedStatements,
+	})
+	hash := sha256.Sum256(data)
+
+	return hex.EncodeToString(hash[:])
+}
+
+/*
+Claim an idempotency key before running a task. If a task with the key has already completed, its result is
+returned so the task isn't run again. A repeat that arrives while the first is still running is refused, as
+is a different task reusing the key.
+*/
+func claimIdempotencyKey(key string, fingerprint string) (interface{}, bool, error) {
+	now := time.Now()
+
+	idempotentTasksLock.Lock()
+	defer idempotentTasksLock.Unlock()
+
+	for k, task := range idempotentTasks {
+		if task.complete && now.After(task.expires) {
+			delete(idempotentTasks, k)
+		}
+	}
+
+	if task, ok := idempotentTasks[key]; ok {
+		if task.fingerprint != fingerprint {
+			return nil, false, &TaskError{
+				Status: http.StatusUnprocessableEntity,
+				Code:   "idempotency_key_reused",
+				Err:    fmt.Errorf("Idempotency key %s was already used for a different task", key),
+			}
+		}
+		if task.complete {
+			return task.result, true, nil
+		}
+		return nil, false, &TaskError{
+			Status: http.StatusConflict,
+			Code:   "in_progress",
+			Err:    fmt.Errorf("A task with idempotency key %s is already running", key),
+		}
+	}
+
+	idempotentTasks[key] = &idempotentTask{fingerprint: fingerprint}
+
+	return nil, false, nil
+}
+
+/*
+Record the outcome of a task run with an idempotency key. A successful result is kept for repeats of the key,
+while a failure releases the key so the task can be retried.
+*/
+func completeIdempotencyKey(key string, fingerprint string, result interface{}, err error) {
+	idempotentTasksLock.Lock()
+	defer idempotentTasksLock.Unlock()
+
+	if err != nil {
+		delete(idempotentTasks, key)
+		return
+	}
+
+	idempotentTasks[key] = &idempotentTask{
+		fingerprint: fingerprint,
+		result:      result,
+		complete:    true,
+		expires:     time.Now().Add(configSeconds(getConfig().IdempotencyTTLSeconds, IDEMPOTENCY_TTL)),
+	}
+}
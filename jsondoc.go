@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	FOR_JSON_COLUMN = "JSON_F52E2B61-18A1-11D1-B105-00805F49916B" // Column SQL Server returns a FOR JSON query's output in
+)
+
+var (
+	// Database types whose values are JSON documents
+	jsonTypes = map[string]bool{
+		"JSON":  true,
+		"JSONB": true,
+	}
+)
+
+/*
+Find the columns of a result set that hold JSON documents, by name
+*/
+func jsonColumns(columnTypes []*sql.ColumnType) map[string]bool {
+	columns := map[string]bool{}
+	for _, columnType := range columnTypes {
+		if jsonTypes[strings.ToUpper(columnType.DatabaseTypeName())] {
+			columns[columnType.Name()] = true
+		}
+	}
+
+	return columns
+}
+
+/*
+Embed the values of JSON columns in the result as the documents they hold, rather than as strings of JSON,
+in place. A value that isn't valid JSON is left as it is.
+*/
+func embedJsonValues(rows []map[string]interface{}, columns map[string]bool) {
+	for _, row := range rows {
+		for column := range columns {
+			var data []byte
+			switch v := row[column].(type) {
+			case string:
+				data = []byte(v)
+			case []byte:
+				data = append([]byte(nil), v...)
+			default:
+				continue
+			}
+			if json.Valid(data) {
+				row[column] = json.RawMessage(data)
+			}
+		}
+	}
+}
+
+/*
+Check whether a result set is the output of a SQL Server `FOR JSON` query
+*/
+func isForJsonResult(columnTypes []*sql.ColumnType) bool {
+	return len(columnTypes) == 1 && strings.EqualFold(columnTypes[0].Name(), FOR_JSON_COLUMN)
+}
+
+/*
+Read the document a `FOR JSON` query returns. SQL Server splits long output across rows of about 2KB each,
+so the rows are joined back together. Returns null when the query matched no rows.
+*/
+func readForJsonDocument(rows *sql.Rows) (json.RawMessage, error) {
+	var document strings.Builder
+	for rows.Next() {
+		var part sql.NullString
+		if err := rows.Scan(&part); err != nil {
+			return nil, err
+		}
+		document.WriteString(part.String)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if document.Len() == 0 {
+		return json.RawMessage("null"), nil
+	}
+	if !json.Valid([]byte(document.String())) {
+		return nil, fmt.Errorf("FOR JSON result is not a valid JSON document")
+	}
+
+	return json.RawMessage(document.String()), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+/*
+Listener that applies the configured TCP keepalive settings to each connection it accepts, so idle
+connections over slow or lossy links are probed on the connector's schedule rather than the OS default
+*/
+type keepAliveListener struct {
+	net.Listener
+	period time.Duration // Time between keepalive probes, or negative to turn keepalives off
+}
+
+/*
+Wrap a listener to apply the `tcp_keep_alive_seconds` config to accepted connections. Left unwrapped when
+it isn't configured, keeping Go's default of keepalives every 15 seconds.
+*/
+func withKeepAlive(listener net.Listener) net.Listener {
+	if getConfig().TCPKeepAliveSeconds == 0 {
+		return listener
+	}
+
+	return &keepAliveListener{
+		Listener: listener,
+		period:   time.Duration(getConfig().TCPKeepAliveSeconds) * time.Second,
+	}
+}
+
+/*
+Accept a connection and set its keepalive
+*/
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return conn, nil
+	}
+
+	if l.period < 0 {
+		err = tcpConn.SetKeepAlive(false)
+	} else if err = tcpConn.SetKeepAlive(true); err == nil {
+		err = tcpConn.SetKeepAlivePeriod(l.period)
+	}
+	if err != nil {
+		svcLogger.Warningf("Unable to set TCP keepalive for %s: %s", conn.RemoteAddr(), err)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AUTH_FAILURE_LIMIT          = 10
+	AUTH_FAILURE_WINDOW_SECONDS = 300
+	AUTH_LOCKOUT_SECONDS        = 900
+)
+
+var (
+	authFailures     = make(map[string]*authFailure) // Recent failed authentication attempts keyed by client IP
+	authFailuresLock sync.Mutex
+
+	openConns     = make(map[net.Conn]string) // Connections counted against their IP's cap, and the IP they're from
+	connsPerIp    = make(map[string]int)      // Open connection count keyed by remote IP
+	openConnsLock sync.Mutex
+)
+
+/*
+Failed authentication attempts from a single client IP
+*/
+type authFailure struct {
+	count       int
+	windowStart time.Time
+	lockedUntil time.Time
+}
+
+/*
+Get the IP address a request was made from. For a request relayed by one of the `TrustedProxies`, this is the
+client IP the proxy reports in `X-Forwarded-For` or `X-Real-IP` - those headers are ignored from anyone else,
+as any client could set them.
+*/
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	// Each proxy appends the address it received the request from, so walk back from the nearest proxy
+	// to the first address that isn't one of ours - anything before it could have been forged by the client
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			ip = hop
+			if !isTrustedProxy(hop) {
+				return ip
+			}
+		}
+		return ip
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+
+	return ip
+}
+
+/*
+Check whether an IP is one of the configured `TrustedProxies`, each given as an IP or a CIDR range
+*/
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, proxy := range getConfig().TrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(parsed) {
+				return true
+			}
+		} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Track open connections per remote IP for a server's ConnState hook, closing new connections from an IP that
+already has `max_connections_per_ip` open. Trusted proxies are exempt, as they carry many clients' connections.
+*/
+func trackConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil || getConfig().MaxConnectionsPerIp <= 0 || isTrustedProxy(ip) {
+			return
+		}
+
+		openConnsLock.Lock()
+		defer openConnsLock.Unlock()
+
+		if connsPerIp[ip] >= getConfig().MaxConnectionsPerIp {
+			svcLogger.Warningf("Refusing connection from %s, which already has %d open", ip, connsPerIp[ip])
+			conn.Close()
+			return
+		}
+		openConns[conn] = ip
+		connsPerIp[ip]++
+	case http.StateClosed, http.StateHijacked:
+		// A hijacked connection e.g. a WebSocket is no longer the server's, so stops being counted
+		openConnsLock.Lock()
+		defer openConnsLock.Unlock()
+
+		ip, ok := openConns[conn]
+		if !ok {
+			return
+		}
+		delete(openConns, conn)
+		if connsPerIp[ip]--; connsPerIp[ip] <= 0 {
+			delete(connsPerIp, ip)
+		}
+	}
+}
+
+/*
+Get a config value in seconds as a duration, falling back to a default when it isn't set
+*/
+func configSeconds(value int, defaultValue int) time.Duration {
+	if value <= 0 {
+		value = defaultValue
+	}
+
+	return time.Duration(value) * time.Second
+}
+
+/*
+Check whether a client IP is currently locked out, returning how long the lockout has left
+*/
+func authLockout(ip string) (bool, time.Duration) {
+	authFailuresLock.Lock()
+	defer authFailuresLock.Unlock()
+
+	failure, ok := authFailures[ip]
+	if !ok {
+		return false, 0
+	}
+
+	remaining := failure.lockedUntil.Sub(time.Now())
+
+	return remaining > 0, remaining
+}
+
+/*
+Record a failed authentication attempt, locking the client IP out once it has failed
+too many times within the window
+*/
+func recordAuthFailure(ip string) {
+	limit := getConfig().AuthFailureLimit
+	if limit <= 0 {
+		limit = AUTH_FAILURE_LIMIT
+	}
+	window := configSeconds(getConfig().AuthFailureWindowSeconds, AUTH_FAILURE_WINDOW_SECONDS)
+	lockout := configSeconds(getConfig().AuthLockoutSeconds, AUTH_LOCKOUT_SECONDS)
+
+	now := time.Now()
+
+	authFailuresLock.Lock()
+	defer authFailuresLock.Unlock()
+
+	// Forget clients whose failures have all expired
+	for key, failure := range authFailures {
+		if now.Sub(failure.windowStart) > window && now.After(failure.lockedUntil) {
+			delete(authFailures, key)
+		}
+	}
+
+	failure, ok := authFailures[ip]
+	if !ok || now.Sub(failure.windowStart) > window {
+		failure = &authFailure{windowStart: now}
+		authFailures[ip] = failure
+	}
+
+	failure.count++
+	if failure.count >= limit {
+		failure.lockedUntil = now.Add(lockout)
+		svcLogger.Warningf("Locking out %s for %s after %d failed authentication attempts", ip, lockout, failure.count)
+	}
+}
+
+/*
+Clear the failed authentication attempts for a client IP after it authenticates successfully
+*/
+func recordAuthSuccess(ip string) {
+	authFailuresLock.Lock()
+	defer authFailuresLock.Unlock()
+
+	delete(authFailures, ip)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MAINTENANCE_RETRY_AFTER = 300 // Seconds clients are asked to wait before retrying a task during maintenance
+)
+
+var (
+	maintenanceMode int32 // Non-zero while task requests are being turned away, set atomically
+)
+
+/*
+The maintenance state, as reported and as set through /admin/maintenance
+*/
+type MaintenanceStatus struct {
+	Enabled bool `json:"enabled"`
+}
+
+/*
+Check whether the connector is in maintenance mode
+*/
+func inMaintenance() bool {
+	return atomic.LoadInt32(&maintenanceMode) != 0
+}
+
+/*
+Switch maintenance mode on or off
+*/
+func setMaintenance(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+
+	atomic.StoreInt32(&maintenanceMode, value)
+}
+
+/*
+Turn a task request away with a 503 if the connector is in maintenance mode or still starting up,
+returning whether it was rejected
+*/
+func rejectForMaintenance(w http.ResponseWriter, r *http.Request) bool {
+	var err *TaskError
+	var retryAfter time.Duration
+
+	switch {
+	case inMaintenance():
+		err = newMaintenanceError()
+		retryAfter = configSeconds(getConfig().MaintenanceRetryAfterSeconds, MAINTENANCE_RETRY_AFTER)
+	case isStarting():
+		err = newStartingError()
+		retryAfter = STARTUP_RETRY_AFTER * time.Second
+	default:
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	status, response := newErrorResponse(err)
+	writeResponse(w, r, status, response)
+
+	return true
+}
+
+/*
+Error returned for a task turned away during maintenance
+*/
+func newMaintenanceError() *TaskError {
+	return &TaskError{
+		Status: http.StatusServiceUnavailable,
+		Code:   "maintenance",
+		Err:    fmt.Errorf("The connector is down for maintenance, please try again later"),
+	}
+}
+
+/*
+Handle an HTTP request to the /admin/maintenance URL - report maintenance mode, or switch it with a POST
+e.g. {"enabled": true}
+*/
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var status MaintenanceStatus
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+		if err == nil {
+			err = json.Unmarshal(body, &status)
+		}
+		if err != nil {
+			writeResponse(w, r, http.StatusBadRequest, JsonResponse{
+				Type: "error",
+				Body: fmt.Sprintf("Invalid maintenance request: %s", err),
+			})
+			return
+		}
+
+		setMaintenance(status.Enabled)
+		svcLogger.Infof("Maintenance mode enabled: %t", status.Enabled)
+	default:
+		writeResponse(w, r, http.StatusMethodNotAllowed, JsonResponse{
+			Type: "error",
+			Body: "Maintenance mode must be read with GET or set with POST",
+		})
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, JsonResponse{
+		Type: "success",
+		Body: MaintenanceStatus{Enabled: inMaintenance()},
+	})
+}
+
+/*
+Handle an HTTP request to the /health URL - report whether the connector is accepting tasks
+*/
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	maintenance := inMaintenance()
+
+	status := "ok"
+	if getConfig().ApiKey == "" {
+		status = "awaiting API key"
+	} else if isStarting() {
+		status = "starting"
+	} else if maintenance {
+		status = "maintenance"
+	}
+
+	writeResponse(w, r, http.StatusOK, JsonResponse{
+		Type: "success",
+		Body: map[string]interface{}{
+			"status":             status,
+			"maintenance":        maintenance,
+			"api_key_configured": getConfig().ApiKey != "",
+		},
+	})
+}
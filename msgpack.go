@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"net/http"
+)
+
+const (
+	OUTPUT_FORMAT_MSGPACK = "msgpack" // Rows, as for OUTPUT_FORMAT_ROWS, but the response is encoded as MessagePack
+)
+
+/*
+Write any value as MessagePack, for tasks with an `output_format` of "msgpack". Fields are named by their
+JSON tags, so the response has the same shape as its JSON equivalent.
+*/
+func writeMsgpack(w http.ResponseWriter, r *http.Request, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/msgpack")
+	w.WriteHeader(status)
+	err := newMsgpackEncoder(w).Encode(response)
+	errCheck(err)
+}
+
+/*
+Encode a value as MessagePack ahead of writing it, as a raw message that writeMsgpack writes as it is
+*/
+func marshalMsgpack(response interface{}) (msgpack.RawMessage, error) {
+	var buffer bytes.Buffer
+	if err := newMsgpackEncoder(&buffer).Encode(response); err != nil {
+		return nil, err
+	}
+
+	return msgpack.RawMessage(buffer.Bytes()), nil
+}
+
+/*
+Create a MessagePack encoder naming fields by their JSON tags, with integers in as few bytes as they fit
+*/
+func newMsgpackEncoder(w io.Writer) *msgpack.Encoder {
+	encoder := msgpack.NewEncoder(w)
+	encoder.SetCustomStructTag("json")
+	encoder.UseCompactInts(true)
+
+	return encoder
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Time formats accepted for params with a "time" type hint
+	paramTimeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"}
+
+	// Types a param can be given in `param_types`
+	paramTypes = map[string]bool{"int": true, "string": true, "float": true, "bool": true, "time": true, "null": true}
+)
+
+/*
+Decode a task's params, which may be an array of positional values or an object of named values.
+Numbers are decoded exactly rather than as float64, so large integer IDs aren't corrupted.
+*/
+func decodeParams(raw json.RawMessage) ([]interface{}, map[string]interface{}, error) {
+	trimmed := strings.TrimSpace(string(raw))
+	if trimmed == "" || trimmed == "null" {
+		return nil, nil, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	if strings.HasPrefix(trimmed, "[") {
+		var positional []interface{}
+		if err := decoder.Decode(&positional); err != nil {
+			return nil, nil, err
+		}
+		for i, value := range positional {
+			positional[i] = convertNumber(value)
+		}
+		return positional, nil, nil
+	}
+	if strings.HasPrefix(trimmed, "{") {
+		var named map[string]interface{}
+		if err := decoder.Decode(&named); err != nil {
+			return nil, nil, err
+		}
+		for name, value := range named {
+			named[name] = convertNumber(value)
+		}
+		return nil, named, nil
+	}
+
+	return nil, nil, fmt.Errorf("params must be an array or an object")
+}
+
+/*
+Convert a decoded json.Number to a value the database drivers can bind - an int64 for integers,
+a float64 for decimals, or the original digits as a string for integers too large for an int64
+*/
+func convertNumber(value interface{}) interface{} {
+	number, ok := value.(json.Number)
+	if !ok {
+		return value
+	}
+
+	if i, err := number.Int64(); err == nil {
+		return i
+	}
+	if !strings.ContainsAny(string(number), ".eE") {
+		return string(number)
+	}
+	if f, err := number.Float64(); err == nil {
+		return f
+	}
+
+	return string(number)
+}
+
+/*
+Convert a decoded positional param to the Go type named by its type hint, so the driver binds it as that type
+e.g. a numeric string as an integer. Null values stay null whatever their type.
+*/
+func coerceParam(value interface{}, paramType string, n int) (interface{}, error) {
+	if value == nil || paramType == "null" {
+		return nil, nil
+	}
+
+	switch paramType {
+	case "string":
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		}
+	case "int":
+		switch v := value.(type) {
+		case int64:
+			return v, nil
+		case float64:
+			if v == float64(int64(v)) {
+				return int64(v), nil
+			}
+		case string:
+			if i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+				return i, nil
+			}
+		}
+	case "float":
+		switch v := value.(type) {
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				return f, nil
+			}
+		}
+	case "bool":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case int64:
+			if v == 0 || v == 1 {
+				return v == 1, nil
+			}
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+				return b, nil
+			}
+		}
+	case "time":
+		if v, ok := value.(string); ok {
+			for _, layout := range paramTimeLayouts {
+				if t, err := time.Parse(layout, v); err == nil {
+					return t, nil
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unknown type %q for param %d", paramType, n)
+	}
+
+	return nil, fmt.Errorf("Invalid %s value for param %d: %v", paramType, n, value)
+}
+
+/*
+Get the placeholder the database's driver uses for the nth (1 based) positional parameter
+*/
+func placeholder(dbType string, n int) string {
+	switch dbType {
+	case "mssql":
+		return "@p" + strconv.Itoa(n)
+	case "oracle":
+		return ":" + strconv.Itoa(n)
+	}
+
+	return "?"
+}
+
+/*
+Check whether a byte may appear in a placeholder name
+*/
+func isParamNameByte(c byte, first bool) bool {
+	if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+		return true
+	}
+
+	return !first && c >= '0' && c <= '9'
+}
+
+/*
+Rewrite `:name` placeholders in a query to the driver's positional placeholders, returning the
+named values in the matching order. Colons inside quoted literals, quoted identifiers and comments
+are left alone, as are `::` casts.
+*/
+func bindNamedParams(dbType string, query string, named map[string]interface{}) (string, []interface{}, error) {
+
+	var out strings.Builder
+	args := []interface{}{}
+
+	// MySQL treats backslash as an escape character inside string literals, other engines don't
+	backslashEscapes := dbType == "mysql" || dbType == "mariadb"
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			// Copy the quoted literal or identifier through unchanged
+			end := i + 1
+			for end < len(query) && query[end] != c {
+				if backslashEscapes && query[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(query) {
+				end = len(query) - 1
+			}
+			out.WriteString(query[i : end+1])
+			i = end
+
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i - 1
+			}
+			out.WriteString(query[i : i+end+1])
+			i += end
+
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = len(query) - i - 2
+			} else {
+				end += 2
+			}
+			out.WriteString(query[i : i+2+end])
+			i += 1 + end
+
+		case c == ':' && i+1 < len(query) && query[i+1] == ':':
+			out.WriteString("::")
+			i++
+
+		case c == ':' && i+1 < len(query) && isParamNameByte(query[i+1], true):
+			end := i + 1
+			for end < len(query) && isParamNameByte(query[end], false) {
+				end++
+			}
+			name := query[i+1 : end]
+
+			value, ok := named[name]
+			if !ok {
+				return "", nil, fmt.Errorf("No value given for parameter :%s", name)
+			}
+			args = append(args, value)
+			out.WriteString(placeholder(dbType, len(args)))
+			i = end - 1
+
+		default:
+			out.WriteByte(c)
+		}
+	}
+
+	return out.String(), args, nil
+}
+
+/*
+Get the statement to run for a task and the arguments to bind to it. Positional params are passed
+to the driver as given, named params are bound to `:name` placeholders in the payload.
+*/
+func taskStatement(task Task, dbType string) (string, []interface{}, error) {
+	positional, named, err := decodeParams(task.Params)
+	if err != nil {
+		return "", nil, &TaskError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("Invalid params: %s", err),
+		}
+	}
+
+	if named == nil {
+		for i, paramType := range task.ParamTypes {
+			if positional[i], err = coerceParam(positional[i], paramType, i+1); err != nil {
+				return "", nil, &TaskError{
+					Status: http.StatusBadRequest,
+					Err:    fmt.Errorf("Invalid params: %s", err),
+				}
+			}
+		}
+		return task.Payload, positional, nil
+	}
+
+	query, args, err := bindNamedParams(dbType, task.Payload, named)
+	if err != nil {
+		return "", nil, &TaskError{
+			Status: http.StatusBadRequest,
+			Err:    err,
+		}
+	}
+
+	return query, args, nil
+}
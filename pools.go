@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	mssql "github.com/denisenkom/go-mssqldb"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	POOL_KEEPALIVE_FAILURES = 3                // Consecutive failed keep-alive pings before a pool is closed
+	DB_QUEUE_LENGTH         = 50               // Tasks that may wait for a database at its concurrency limit
+	DB_QUEUE_WAIT           = 10 * time.Second // Time a task waits for a database at its concurrency limit
+)
+
+var (
+	dbPools     = make(map[string]*sql.DB) // Open connection pools keyed by database type and DSN
+	dbPoolsLock sync.Mutex
+
+	dbSlots     = make(map[string]*dbSemaphore) // Concurrency limits for databases that have one, keyed like dbPools
+	dbSlotsLock sync.Mutex
+)
+
+/*
+Limits the tasks running against one database, with a short queue for tasks waiting their turn
+*/
+type dbSemaphore struct {
+	limit    int           // Tasks allowed at once, changed in place so tasks already running still count against it
+	running  int           // Tasks holding a turn
+	waiting  int           // Tasks queued for a turn
+	released chan struct{} // Closed and replaced whenever a turn may have come free, waking the queued tasks
+}
+
+/*
+Wake the tasks queued for a turn, to check whether one is free. Must be called holding dbSlotsLock.
+*/
+func (s *dbSemaphore) wake() {
+	close(s.released)
+	s.released = make(chan struct{})
+}
+
+/*
+Take a turn if one is free. Must be called holding dbSlotsLock.
+*/
+func (s *dbSemaphore) tryAcquire() bool {
+	if s.running >= s.limit {
+		return false
+	}
+	s.running++
+
+	return true
+}
+
+/*
+Give back a turn, waking the queued tasks
+*/
+func (s *dbSemaphore) release() {
+	dbSlotsLock.Lock()
+	defer dbSlotsLock.Unlock()
+
+	s.running--
+	s.wake()
+}
+
+/*
+Identify the connections a database config opens - configs with the same key can share a pool
+*/
+func dbPoolKey(dbConfig TaskDbConfig) string {
+	key := dbConfig.Type + "|" + dbConfig.Dsn
+
+	// Connections set up differently can't be shared
+	if len(dbConfig.InitStatements) > 0 {
+		key += "|" + strings.Join(dbConfig.InitStatements, "\x00")
+	}
+	if dbConfig.AzureAuth != nil {
+		key += "|azure:" + azureAuthKey(*dbConfig.AzureAuth)
+	}
+
+	return key
+}
+
+/*
+Get the configured `db_conn_max_lifetime_seconds` as a duration, 0 keeping connections indefinitely
+*/
+func dbConnMaxLifetime() time.Duration {
+	if getConfig().DbConnMaxLifetimeSeconds <= 0 {
+		return 0
+	}
+
+	return time.Duration(getConfig().DbConnMaxLifetimeSeconds) * time.Second
+}
+
+/*
+Apply the configured connection lifetime to every open pool, after it is changed at runtime
+*/
+func applyDbConnMaxLifetime() {
+	lifetime := dbConnMaxLifetime()
+
+	dbPoolsLock.Lock()
+	defer dbPoolsLock.Unlock()
+
+	for _, db := range dbPools {
+		db.SetConnMaxLifetime(lifetime)
+	}
+}
+
+/*
+Get the connection pool for a database config, opening it on first use.
+Pools are kept open for the life of the process and shared between tasks.
+*/
+func getDbPool(dbConfig TaskDbConfig) (*sql.DB, error) {
+	key := dbPoolKey(dbConfig)
+
+	dbPoolsLock.Lock()
+	defer dbPoolsLock.Unlock()
+
+	if db, ok := dbPools[key]; ok {
+		return db, nil
+	}
+
+	db, err := openDb(dbConfig)
+	if err != nil {
+		return nil, err
+	}
+	idle := 100
+	if dbConfig.MinConnections > idle {
+		idle = dbConfig.MinConnections
+	}
+	db.SetMaxIdleConns(idle)
+	db.SetConnMaxLifetime(dbConnMaxLifetime())
+
+	dbPools[key] = db
+
+	if dbConfig.MinConnections > 0 {
+		go warmDbPool(db, dbConfig.Type, dbConfig.MinConnections)
+	}
+
+	return db, nil
+}
+
+/*
+Close and forget every open pool whose key matches, e.g. the pools reaching a database through a closed tunnel
+*/
+func closeDbPools(match func(key string) bool) {
+	dbPoolsLock.Lock()
+	var closing []*sql.DB
+	for key, db := range dbPools {
+		if match(key) {
+			closing = append(closing, db)
+			delete(dbPools, key)
+		}
+	}
+	dbPoolsLock.Unlock()
+
+	for _, db := range closing {
+		errCheck(db.Close())
+	}
+}
+
+/*
+Open `min_connections` connections in a new pool, so the first burst of tasks doesn't wait on connection setup.
+Each is pinged on a connection of its own, held until all have connected, then left idle in the pool.
+*/
+func warmDbPool(db *sql.DB, dbType string, connections int) {
+	ctx, cancel := context.WithTimeout(context.Background(), DB_CONNECT_TIMEOUT*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var failed int32
+	conns := make(chan *sql.Conn, connections)
+	for i := 0; i < connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := db.Conn(ctx)
+			if err == nil {
+				err = conn.PingContext(ctx)
+				conns <- conn
+			}
+			if err != nil {
+				atomic.AddInt32(&failed, 1)
+				svcLogger.Warningf("Unable to warm a %s pool connection: %s", dbType, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(conns)
+
+	for conn := range conns {
+		errCheck(conn.Close())
+	}
+
+	svcLogger.Infof("Warmed a %s pool with %d of %d connections", dbType, int32(connections)-failed, connections)
+}
+
+/*
+Open a connection pool for a database config. Azure SQL with `azure_auth` connects with an access token,
+fetched through the driver's access token connector as each connection is opened. Databases with session
+setup, such as `session_timezone` or `init_statements`, have it run on each connection as it is opened.
+*/
+func openDb(dbConfig TaskDbConfig) (*sql.DB, error) {
+	dbConfig.Dsn = withApplicationName(dbConfig.Type, dbConfig.Dsn)
+
+	statements, err := sessionStatements(dbConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if dbConfig.AzureAuth == nil && len(statements) == 0 {
+		return sql.Open(dbDriverName(dbConfig.Type), dbConfig.Dsn)
+	}
+
+	var connector driver.Connector
+	if dbConfig.AzureAuth != nil {
+		if dbConfig.Type != "mssql" {
+			return nil, fmt.Errorf("Azure token authentication is not supported for database type: %s", dbConfig.Type)
+		}
+		connector, err = mssql.NewAccessTokenConnector(dbConfig.Dsn, newAzureTokenProvider(*dbConfig.AzureAuth))
+	} else {
+		connector, err = driverConnector(dbDriverName(dbConfig.Type), dbConfig.Dsn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(statements) > 0 {
+		connector = &sessionConnector{base: connector, statements: statements}
+	}
+
+	return sql.OpenDB(connector), nil
+}
+
+/*
+Wait for a turn to run a task against a database with `max_concurrent_queries` set. Tasks over the limit queue
+for a short time, and are refused with a 503 if the queue is full or no turn comes up. The returned
+function must be called when the task is done with the database.
+*/
+func acquireDbSlot(ctx context.Context, task Task) (func(), error) {
+	dbConfig, err := getTaskDbConfig(task)
+	if err != nil {
+		return nil, err
+	}
+	if dbConfig.MaxConcurrentQueries <= 0 {
+		return func() {}, nil
+	}
+
+	key := dbConfig.Type + "|" + dbConfig.Dsn
+
+	dbSlotsLock.Lock()
+	defer dbSlotsLock.Unlock()
+
+	semaphore, ok := dbSlots[key]
+	if !ok {
+		semaphore = &dbSemaphore{released: make(chan struct{})}
+		dbSlots[key] = semaphore
+	}
+	// A changed limit applies to the same semaphore, so the tasks running under the old limit still count
+	if semaphore.limit != dbConfig.MaxConcurrentQueries {
+		if dbConfig.MaxConcurrentQueries > semaphore.limit {
+			defer semaphore.wake()
+		}
+		semaphore.limit = dbConfig.MaxConcurrentQueries
+	}
+
+	// Take a free turn straight away where there is one, without joining the queue
+	if semaphore.tryAcquire() {
+		return semaphore.release, nil
+	}
+
+	if semaphore.waiting >= DB_QUEUE_LENGTH {
+		return nil, newDbBusyError(dbConfig.Type)
+	}
+	semaphore.waiting++
+	defer func() {
+		semaphore.waiting--
+	}()
+
+	timer := time.NewTimer(DB_QUEUE_WAIT)
+	defer timer.Stop()
+
+	for {
+		released := semaphore.released
+		dbSlotsLock.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			dbSlotsLock.Lock()
+			return nil, ctx.Err()
+		case <-timer.C:
+			dbSlotsLock.Lock()
+			return nil, newDbBusyError(dbConfig.Type)
+		}
+
+		dbSlotsLock.Lock()
+		if semaphore.tryAcquire() {
+			return semaphore.release, nil
+		}
+	}
+}
+
+/*
+Create an error for a task turned away because its database is already running as many tasks as it's allowed
+*/
+func newDbBusyError(dbType string) *TaskError {
+	return &TaskError{
+		Status: http.StatusServiceUnavailable,
+		Code:   "db_busy",
+		Err:    fmt.Errorf("The %s database is busy, try again later", dbType),
+	}
+}
+
+/*
+Ping every open pool at the configured interval, keeping a connection warm so the first task after a quiet
+period doesn't pay to reconnect, and noticing lost databases early. Pools that repeatedly fail are closed,
+to be reopened by the next task that needs them.
+*/
+func keepPoolsAlive(interval time.Duration) {
+	failures := make(map[string]int)
+
+	for range time.Tick(interval) {
+		dbPoolsLock.Lock()
+		pools := make(map[string]*sql.DB, len(dbPools))
+		for key, db := range dbPools {
+			pools[key] = db
+		}
+		dbPoolsLock.Unlock()
+
+		for key, db := range pools {
+			ctx, cancel := context.WithTimeout(context.Background(), DB_CONNECT_TIMEOUT*time.Second)
+			err := db.PingContext(ctx)
+			cancel()
+
+			if err == nil {
+				delete(failures, key)
+				continue
+			}
+
+			failures[key]++
+			svcLogger.Warningf("Keep-alive ping failed for a %s pool (%d of %d): %s", strings.SplitN(key, "|", 2)[0], failures[key], POOL_KEEPALIVE_FAILURES, err)
+			if failures[key] < POOL_KEEPALIVE_FAILURES {
+				continue
+			}
+
+			delete(failures, key)
+			dbPoolsLock.Lock()
+			if dbPools[key] == db {
+				delete(dbPools, key)
+			}
+			dbPoolsLock.Unlock()
+			errCheck(db.Close())
+		}
+	}
+}
+
+/*
+Count the connection pools currently open
+*/
+func countDbPools() int {
+	dbPoolsLock.Lock()
+	defer dbPoolsLock.Unlock()
+
+	return len(dbPools)
+}
+
+/*
+Get the name of the database/sql driver registered for a database type
+*/
+func dbDriverName(dbType string) string {
+	if name, ok := dbDrivers[dbType]; ok {
+		return name
+	}
+
+	return dbType
+}
+
+/*
+Check whether an error means a pooled connection had already been closed by the server, before the statement
+was sent. Only driver.ErrBadConn promises that - errors such as the MySQL driver's ErrInvalidConn can come
+after the statement reached the server, so retrying on them could run it twice.
+*/
+func isBadConnError(err error) bool {
+	return errors.Is(err, driver.ErrBadConn)
+}
+
+/*
+Check the database can be reached, giving up once the connect timeout has elapsed - an unreachable host
+behind a firewall that drops packets would otherwise hold the task until the request times out
+*/
+func pingDb(ctx context.Context, db *sql.DB, timeout time.Duration) error {
+	pingCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := db.PingContext(pingCtx)
+	if err != nil && pingCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return &TaskError{
+			Status: http.StatusGatewayTimeout,
+			Code:   "db_connect_timeout",
+			Err:    fmt.Errorf("Timed out connecting to the database after %s", timeout),
+		}
+	}
+
+	return err
+}
+
+/*
+Run a query, retrying once on a fresh connection if the pooled connection has gone stale
+e.g. after the server's `wait_timeout` has elapsed. Queries can be batches or CALLs that write, so only
+errors that guarantee the statement wasn't sent are retried, as for execDb.
+*/
+func queryDb(ctx context.Context, db *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if isBadConnError(err) {
+		svcLogger.Warning("Stale database connection, retrying query on a new connection")
+		rows, err = db.QueryContext(ctx, query, args...)
+	}
+
+	return rows, err
+}
+
+/*
+Execute a statement, retrying once on a fresh connection if the pooled connection has gone stale.
+Only driver.ErrBadConn is retried here, as the driver guarantees the statement was not sent -
+retrying other connection errors could run a non-idempotent statement twice.
+*/
+func execDb(ctx context.Context, db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	result, err := db.ExecContext(ctx, query, args...)
+	if isBadConnError(err) {
+		svcLogger.Warning("Stale database connection, retrying statement on a new connection")
+		result, err = db.ExecContext(ctx, query, args...)
+	}
+
+	return result, err
+}
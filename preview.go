@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	PREVIEW_ROW_LIMIT = 100 // Most rows returned by an affected row preview
+)
+
+var (
+	// Simple single table statements, the only ones whose affected rows can be selected reliably
+	updatePattern = regexp.MustCompile(`(?is)^\s*UPDATE\s+([\w.\[\]"]+)\s+SET\s+(.+?)(?:\s+WHERE\s+(.+?))?\s*;?\s*$`)
+	deletePattern = regexp.MustCompile(`(?is)^\s*DELETE\s+(?:FROM\s+)?([\w.\[\]"]+)(?:\s+WHERE\s+(.+?))?\s*;?\s*$`)
+
+	// Placeholders in any of the forms statements are bound with - `?`, `@p1`, `:1` or `:name`
+	bindPlaceholderPattern = regexp.MustCompile(`\?|@p\d|:\w`)
+
+	// SET clauses that could hide another WHERE, or a second table, from the simple pattern above
+	complexSetPattern = regexp.MustCompile(`(?i)\b(SELECT|FROM|WHERE)\b`)
+)
+
+/*
+Build a SELECT of the rows an UPDATE or DELETE will affect, capped at PREVIEW_ROW_LIMIT rows, so they can
+be returned before the statement runs. Only single table statements that can be rewritten without changing
+their bound values are previewed - otherwise a reason is returned instead.
+*/
+func previewStatement(dbType string, query string) (string, error) {
+	if strings.Contains(strings.TrimRight(strings.TrimSpace(query), ";"), ";") {
+		return "", fmt.Errorf("statements with more than one query can't be previewed")
+	}
+
+	var table, where string
+	if match := updatePattern.FindStringSubmatch(query); match != nil {
+		set := match[2]
+		if complexSetPattern.MatchString(set) {
+			return "", fmt.Errorf("UPDATE statements with subqueries or joins can't be previewed")
+		}
+		// Bound values in the SET clause come before the WHERE clause's, which would leave them misnumbered
+		if bindPlaceholderPattern.MatchString(set) {
+			return "", fmt.Errorf("UPDATE statements with bound values in the SET clause can't be previewed")
+		}
+		table, where = match[1], match[3]
+	} else if match := deletePattern.FindStringSubmatch(query); match != nil {
+		table, where = match[1], match[2]
+	} else {
+		return "", fmt.Errorf("only single table UPDATE and DELETE statements can be previewed")
+	}
+
+	if where == "" {
+		where = "1 = 1"
+	}
+
+	switch dbType {
+	case "mssql":
+		return fmt.Sprintf("SELECT TOP %d * FROM %s WHERE %s", PREVIEW_ROW_LIMIT, table, where), nil
+	case "oracle":
+		return fmt.Sprintf("SELECT * FROM %s WHERE (%s) AND ROWNUM <= %d", table, where, PREVIEW_ROW_LIMIT), nil
+	}
+
+	return fmt.Sprintf("SELECT * FROM %s WHERE %s LIMIT %d", table, where, PREVIEW_ROW_LIMIT), nil
+}
+
+/*
+Select the rows a statement is about to affect, as they are before it runs. A statement that can't be
+previewed still runs, with the reason added to the response's warnings.
+*/
+func previewAffectedRows(ctx context.Context, db *sql.DB, task Task, dbConfig TaskDbConfig, query string, args []interface{}, meta ResponseMeta) (interface{}, error) {
+	previewQuery, err := previewStatement(dbConfig.Type, query)
+	if err != nil {
+		addWarning(meta, fmt.Sprintf("preview_affected: %s", err))
+		return nil, nil
+	}
+
+	// The rewrite can't account for every dialect's extras e.g. MySQL's `UPDATE ... LIMIT`, so a preview the
+	// database rejects is reported rather than stopping the statement
+	rows, err := queryDb(ctx, db, previewQuery, args...)
+	if err != nil {
+		addWarning(meta, fmt.Sprintf("preview_affected: the preview query failed: %s", err))
+		return nil, nil
+	}
+	defer rows.Close()
+
+	preview, err := mapResultSet(task, dbConfig.Charset, rows, meta)
+	if err != nil {
+		return nil, err
+	}
+	if countResultRows(preview) >= PREVIEW_ROW_LIMIT {
+		addWarning(meta, fmt.Sprintf("preview_affected: only the first %d affected rows are shown", PREVIEW_ROW_LIMIT))
+	}
+
+	return preview, rows.Err()
+}
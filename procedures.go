@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	procNamePattern = regexp.MustCompile(`^[\w.\[\]]+$`) // Stored procedure names may be schema qualified or bracket quoted
+)
+
+/*
+A typed parameter for a stored procedure call, optionally bound as an OUTPUT/INOUT parameter
+*/
+type TaskProcParam struct {
+	Name   string      `json:"name"`
+	Type   string      `json:"type"` // "string", "int", "float", "bool" or "bytes"
+	Value  interface{} `json:"value"`
+	Output bool        `json:"output"`
+}
+
+/*
+The result sets and output parameter values returned from a stored procedure call
+*/
+type DbProcResult struct {
+	ResultSets []interface{}          `json:"result_sets"`
+	Output     map[string]interface{} `json:"output"`
+}
+
+/*
+Convert a JSON decoded parameter value to the Go type named by the parameter
+*/
+func coerceProcParam(param TaskProcParam) (interface{}, error) {
+	if param.Value == nil {
+		return nil, nil
+	}
+
+	switch param.Type {
+	case "", "string":
+		if v, ok := param.Value.(string); ok {
+			return v, nil
+		}
+		return fmt.Sprint(param.Value), nil
+	case "int":
+		switch v := param.Value.(type) {
+		case json.Number:
+			return v.Int64()
+		case float64:
+			return int64(v), nil
+		case string:
+			return strconv.ParseInt(v, 10, 64)
+		}
+	case "float":
+		switch v := param.Value.(type) {
+		case json.Number:
+			return v.Float64()
+		case float64:
+			return v, nil
+		case string:
+			return strconv.ParseFloat(v, 64)
+		}
+	case "bool":
+		switch v := param.Value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(v)
+		}
+	case "bytes":
+		if v, ok := param.Value.(string); ok {
+			return []byte(v), nil
+		}
+	default:
+		return nil, fmt.Errorf("Unknown type %q for parameter %s", param.Type, param.Name)
+	}
+
+	return nil, fmt.Errorf("Invalid %s value for parameter %s: %v", param.Type, param.Name, param.Value)
+}
+
+/*
+Create a pointer of the parameter's type to receive an output value, initialised with any input value
+*/
+func newProcOutputDest(param TaskProcParam, value interface{}) (interface{}, error) {
+	switch param.Type {
+	case "", "string":
+		dest, _ := value.(string)
+		return &dest, nil
+	case "int":
+		dest, _ := value.(int64)
+		return &dest, nil
+	case "float":
+		dest, _ := value.(float64)
+		return &dest, nil
+	case "bool":
+		dest, _ := value.(bool)
+		return &dest, nil
+	case "bytes":
+		dest, _ := value.([]byte)
+		return &dest, nil
+	}
+
+	return nil, fmt.Errorf("Unknown type %q for parameter %s", param.Type, param.Name)
+}
+
+/*
+Call a stored procedure, binding named and output parameters, and return its result sets along with the output values.
+Output parameters are only supported by MSSQL; MySQL procedures may be called with input parameters.
+*/
+func processDbCallProc(ctx context.Context, task Task, meta ResponseMeta) (DbProcResult, error) {
+
+	response := DbProcResult{
+		ResultSets: []interface{}{},
+		Output:     map[string]interface{}{},
+	}
+
+	procName := strings.TrimSpace(task.Payload)
+	if !procNamePattern.MatchString(procName) {
+		return response, fmt.Errorf("Invalid stored procedure name: %s", procName)
+	}
+
+	fmt.Print("Calling stored procedure: ")
+	fmt.Println(procName)
+
+	dbConfig, err := getTaskDbConfig(task)
+	if err != nil {
+		return response, err
+	}
+
+	args := []interface{}{}
+	outputs := map[string]interface{}{}
+	for _, param := range task.ProcParams {
+		value, err := coerceProcParam(param)
+		if err != nil {
+			return response, err
+		}
+
+		switch {
+		case dbConfig.Type == "mssql" && param.Output:
+			dest, err := newProcOutputDest(param, value)
+			if err != nil {
+				return response, err
+			}
+			outputs[param.Name] = dest
+			args = append(args, sql.Named(param.Name, sql.Out{Dest: dest, In: value != nil}))
+		case dbConfig.Type == "mssql":
+			args = append(args, sql.Named(param.Name, value))
+		case param.Output:
+			return response, fmt.Errorf("Output parameters are not supported for database type: %s", dbConfig.Type)
+		default:
+			args = append(args, value)
+		}
+	}
+
+	// The MSSQL driver executes a bare procedure name as an RPC call with named parameters,
+	// other drivers need a CALL statement with positional placeholders
+	query := procName
+	if dbConfig.Type != "mssql" {
+		query = fmt.Sprintf("CALL %s(%s)", procName, strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", "))
+	}
+
+	db, err := initDbConnection(ctx, task)
+	if err != nil {
+		return response, err
+	}
+
+	// Not retried on a stale connection, as the procedure may have side effects
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return response, err
+	}
+
+	for {
+		resultSet, err := mapResultSet(task, dbConfig.Charset, rows, meta)
+		if err != nil {
+			rows.Close()
+			return response, err
+		}
+		response.ResultSets = append(response.ResultSets, resultSet)
+
+		if !rows.NextResultSet() {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return response, err
+	}
+
+	// Output parameters are only populated once the results have been fully consumed and closed
+	if err := rows.Close(); err != nil {
+		return response, err
+	}
+	for name, dest := range outputs {
+		switch v := dest.(type) {
+		case *string:
+			response.Output[name] = *v
+		case *int64:
+			response.Output[name] = *v
+		case *float64:
+			response.Output[name] = *v
+		case *bool:
+			response.Output[name] = *v
+		case *[]byte:
+			response.Output[name] = string(*v)
+		}
+	}
+
+	return response, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/propagation"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PROGRESS_INTERVAL = time.Second // Interval between progress events on a task's progress stream
+)
+
+/*
+Context key for a task's progress counter
+*/
+type progressKey struct{}
+
+/*
+How far a long running task has got, updated atomically as it works
+*/
+type taskProgress struct {
+	rows int64
+}
+
+/*
+Attach a progress counter to a context, for the task run with it to report to
+*/
+func withProgress(ctx context.Context, progress *taskProgress) context.Context {
+	return context.WithValue(ctx, progressKey{}, progress)
+}
+
+/*
+Get the progress counter attached to a context, or nil if nobody is watching the task's progress
+*/
+func progressFromContext(ctx context.Context) *taskProgress {
+	progress, _ := ctx.Value(progressKey{}).(*taskProgress)
+	return progress
+}
+
+/*
+Record the rows a task has processed so far, if its progress is being watched
+*/
+func reportProgress(ctx context.Context, rows int64) {
+	if progress := progressFromContext(ctx); progress != nil {
+		atomic.StoreInt64(&progress.rows, rows)
+	}
+}
+
+/*
+Handle an HTTP request to the /task/progress URL - run a `db.bulkinsert` task as /task would, streaming
+a `progress` Server-Sent Event with the rows done so far every second, then a `result` event with the
+task's response. As for /task, a client disconnecting cancels the task.
+*/
+func handleTaskProgress(w http.ResponseWriter, r *http.Request) {
+
+	if rejectForMaintenance(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeResponse(w, r, http.StatusMethodNotAllowed, JsonResponse{
+			Type: "error",
+			Body: "Task progress must be requested with POST",
+		})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeResponse(w, r, http.StatusInternalServerError, JsonResponse{
+			Type: "error",
+			Body: "Streaming is not supported",
+		})
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err == nil {
+		var task Task
+		if task, err = parseTask(body); err == nil && task.Type != TASK_TYPE_DB_BULK_INSERT {
+			err = fmt.Errorf("Only %s tasks can be made through /task/progress", TASK_TYPE_DB_BULK_INSERT)
+		}
+	}
+	if err != nil {
+		status, response := newErrorResponse(err)
+		if _, ok := err.(*TaskError); !ok {
+			status = http.StatusBadRequest
+		}
+		writeResponse(w, r, status, response)
+		return
+	}
+
+	ctx, span := startRequestSpan(r.Context(), propagation.HeaderCarrier(r.Header), "handleTaskProgress")
+	progress := &taskProgress{}
+	ctx = withProgress(ctx, progress)
+
+	// The task is audited however it ends, including cancelled by the client disconnecting
+	finished := make(chan JsonResponse, 1)
+	go func() {
+		started := time.Now()
+		task, response, meta, err := processTask(ctx, body)
+		writeAuditEntry(task, clientIP(r), response, started, err)
+		recordTaskMetrics(task, started, err)
+		endSpan(span, err)
+
+		if err != nil {
+			_, errorResponse := newErrorResponse(err)
+			finished <- errorResponse
+			return
+		}
+		finished <- JsonResponse{
+			Type: "success",
+			Body: response,
+			Meta: meta,
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(PROGRESS_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case response := <-finished:
+			writeEvent(w, flusher, "result", response)
+			return
+		case <-ticker.C:
+			if err := writeEvent(w, flusher, "progress", map[string]interface{}{"progress": atomic.LoadInt64(&progress.rows)}); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+const (
+	TASK_WORKERS    = 32  // Tasks run at once, unless configured
+	TASK_QUEUE_SIZE = 256 // Tasks waiting for a worker before more are refused, unless configured
+)
+
+var (
+	taskQueue chan *queuedTask // Tasks waiting for a worker, nil until the workers are started
+)
+
+/*
+A task waiting in the queue for a worker to run it
+*/
+type queuedTask struct {
+	ctx    context.Context
+	run    func(ctx context.Context) (interface{}, error)
+	claim  int32 // Set by whichever of the worker and the waiting caller takes the task first
+	result chan queuedResult
+}
+
+/*
+The outcome of a queued task, handed back to the caller waiting for it
+*/
+type queuedResult struct {
+	response interface{}
+	err      error
+}
+
+/*
+Start the workers that run tasks from the queue. The number of workers, and the length of the queue in
+front of them, bound how much work the connector takes on however bursty the requests are. The workers
+outlive a restart of the servers, so they are only started once.
+*/
+func startTaskWorkers() {
+	if taskQueue != nil {
+		return
+	}
+
+	workers := getConfig().TaskWorkers
+	if workers <= 0 {
+		workers = TASK_WORKERS
+	}
+	queueSize := getConfig().TaskQueueSize
+	if queueSize <= 0 {
+		queueSize = TASK_QUEUE_SIZE
+	}
+
+	taskQueue = make(chan *queuedTask, queueSize)
+	for i := 0; i < workers; i++ {
+		go runTaskWorker(taskQueue)
+	}
+
+	svcLogger.Infof("Started %d task workers, queueing up to %d tasks", workers, queueSize)
+}
+
+/*
+Run tasks from the queue until it is closed, skipping any whose caller has already given up on them
+*/
+func runTaskWorker(queue chan *queuedTask) {
+	for task := range queue {
+		if !atomic.CompareAndSwapInt32(&task.claim, 0, 1) {
+			continue
+		}
+		response, err := runRecovered(task)
+		task.result <- queuedResult{response: response, err: err}
+	}
+}
+
+/*
+Run a queued task, turning a panic into an error for its caller - a panic on a worker would otherwise take
+the whole connector down, rather than just the request
+*/
+func runRecovered(task *queuedTask) (response interface{}, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			svcLogger.Errorf("Panic while processing task: %v\n%s", recovered, debug.Stack())
+			err = &TaskError{
+				Status: http.StatusInternalServerError,
+				Code:   "panic",
+				Err:    fmt.Errorf("Internal error: %v", recovered),
+			}
+		}
+	}()
+
+	return task.run(task.ctx)
+}
+
+/*
+Queue a task for a worker and wait for its result. A full queue refuses the task with a 503 straight away.
+A task cancelled while it waits is taken out of the queue, but one a worker has started is waited for, so
+its result isn't written to after the caller has moved on.
+*/
+func runQueued(ctx context.Context, run func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if taskQueue == nil {
+		return run(ctx)
+	}
+
+	task := &queuedTask{
+		ctx:    ctx,
+		run:    run,
+		result: make(chan queuedResult, 1),
+	}
+
+	select {
+	case taskQueue <- task:
+	default:
+		return nil, newQueueFullError()
+	}
+
+	select {
+	case result := <-task.result:
+		return result.response, result.err
+	case <-ctx.Done():
+		if atomic.CompareAndSwapInt32(&task.claim, 0, 1) {
+			return nil, ctx.Err()
+		}
+		result := <-task.result
+		return result.response, result.err
+	}
+}
+
+/*
+Create an error for a task turned away because the queue for the task workers is full
+*/
+func newQueueFullError() *TaskError {
+	return &TaskError{
+		Status: http.StatusServiceUnavailable,
+		Code:   "queue_full",
+		Err:    fmt.Errorf("The connector is busy with other tasks, try again later"),
+	}
+}
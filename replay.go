@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+/*
+Rows read from a result set, served back through database/sql as a result set of their own. The row mapper
+only reads a whole *sql.Rows, so replaying lets the connector read part of a result set, or keep the raw
+values of some columns, while every value still goes through the mapper's usual conversion.
+*/
+type replayRows struct {
+	columnTypes []*sql.ColumnType
+	values      [][]interface{}
+	next        int
+}
+
+/*
+A connection that returns the replayed rows for any query, as the only thing run on it is the replay
+*/
+type replayConn struct {
+	rows *replayRows
+}
+
+type replayDriver struct{}
+
+func (replayDriver) Open(string) (driver.Conn, error) {
+	return nil, fmt.Errorf("Replayed rows can't be opened by name")
+}
+
+func (c *replayConn) Connect(context.Context) (driver.Conn, error) {
+	return c, nil
+}
+
+func (c *replayConn) Driver() driver.Driver {
+	return replayDriver{}
+}
+
+func (c *replayConn) Prepare(string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("Replayed rows can't be prepared")
+}
+
+func (c *replayConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("Replayed rows can't be run in a transaction")
+}
+
+func (c *replayConn) Close() error {
+	return nil
+}
+
+func (c *replayConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return c.rows, nil
+}
+
+func (r *replayRows) Columns() []string {
+	columns := make([]string, len(r.columnTypes))
+	for i, columnType := range r.columnTypes {
+		columns[i] = columnType.Name()
+	}
+
+	return columns
+}
+
+func (r *replayRows) Close() error {
+	return nil
+}
+
+func (r *replayRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.values) {
+		return io.EOF
+	}
+	for i, value := range r.values[r.next] {
+		dest[i] = value
+	}
+	r.next++
+
+	return nil
+}
+
+// The column types are the original result set's, so the mapper types the replayed values as it would have
+
+func (r *replayRows) ColumnTypeDatabaseTypeName(index int) string {
+	return r.columnTypes[index].DatabaseTypeName()
+}
+
+func (r *replayRows) ColumnTypeScanType(index int) reflect.Type {
+	return r.columnTypes[index].ScanType()
+}
+
+func (r *replayRows) ColumnTypeNullable(index int) (bool, bool) {
+	return r.columnTypes[index].Nullable()
+}
+
+func (r *replayRows) ColumnTypeLength(index int) (int64, bool) {
+	return r.columnTypes[index].Length()
+}
+
+func (r *replayRows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	return r.columnTypes[index].DecimalSize()
+}
+
+/*
+Read the raw values of the current result set's rows, up to a limit when it is above 0. Rows past the limit
+are left for the driver to discard.
+*/
+func readRowValues(rows *sql.Rows, columnTypes []*sql.ColumnType, limit int) ([][]interface{}, error) {
+	result := [][]interface{}{}
+	for (limit <= 0 || len(result) < limit) && rows.Next() {
+		values := make([]interface{}, len(columnTypes))
+		pointers := make([]interface{}, len(columnTypes))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		result = append(result, values)
+	}
+
+	return result, rows.Err()
+}
+
+/*
+Map rows already read from a result set with the row mapper, as if they came straight from the database
+*/
+func mapReplayedRows(columnTypes []*sql.ColumnType, values [][]interface{}, mapRows func(rows *sql.Rows) ([]map[string]interface{}, error)) ([]map[string]interface{}, error) {
+	db := sql.OpenDB(&replayConn{rows: &replayRows{columnTypes: columnTypes, values: values}})
+	defer db.Close()
+
+	rows, err := db.Query("")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mappedRows, err := mapRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return mappedRows, rows.Err()
+}
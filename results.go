@@ -0,0 +1,780 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/markokeeffe/mapquery"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	FIELD_CASE_AS_IS = "as_is"
+	FIELD_CASE_SNAKE = "snake"
+	FIELD_CASE_CAMEL = "camel"
+
+	OUTPUT_FORMAT_ROWS     = "rows"
+	OUTPUT_FORMAT_COLUMNAR = "columnar"
+
+	TIME_FORMAT_RFC3339      = "rfc3339"
+	TIME_FORMAT_RFC3339_NANO = "rfc3339nano"
+
+	DECIMAL_FORMAT_STRING = "string"
+	DECIMAL_FORMAT_NUMBER = "number"
+)
+
+var (
+	// Transforms a task can apply to column values with `transforms`, by name
+	columnTransforms = map[string]func(value interface{}) interface{}{
+		"trim":    transformString(strings.TrimSpace),
+		"upper":   transformString(strings.ToUpper),
+		"lower":   transformString(strings.ToLower),
+		"iso8601": transformIso8601,
+	}
+
+	// Exact numeric column types, which lose precision as floats, by the name the driver reports
+	decimalTypes = map[string]bool{"DECIMAL": true, "NUMERIC": true, "MONEY": true, "SMALLMONEY": true}
+
+	// Date and time column types, by the name the driver reports, whose text values `time_format` applies to
+	dateTimeTypes = map[string]bool{"DATE": true, "DATETIME": true, "DATETIME2": true, "SMALLDATETIME": true, "TIMESTAMP": true, "TIMESTAMPTZ": true}
+
+	// Date/time formats databases return as text, tried in turn by the iso8601 transform and `time_format`
+	dateTimeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006-01-02T15:04:05.999999999", "2006-01-02"}
+
+	// Matches a statement that only reads rows, so is safe to run again e.g. "SELECT id FROM users", but
+	// not "SELECT * INTO archive FROM users", which the INTO pattern catches
+	selectPattern     = regexp.MustCompile(`(?is)^[\s(]*SELECT\b`)
+	selectIntoPattern = regexp.MustCompile(`(?i)\bINTO\b`)
+)
+
+/*
+A value in a result set the row mapper couldn't convert, as opposed to an error reading the rows from the
+database. Only this is worth running a query again for, with the values coerced to strings.
+*/
+type MapperError struct {
+	Err error
+}
+
+func (e *MapperError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *MapperError) Unwrap() error {
+	return e.Err
+}
+
+/*
+A result set laid out by column rather than by row, with the columns listed in the order the query returned them
+*/
+type ColumnarResultSet struct {
+	Columns []string                 `json:"columns"`
+	Data    map[string][]interface{} `json:"data"`
+}
+
+/*
+The result sets of a batch keyed by the task's `result_keys`, with the keys in the order the batch returned them
+*/
+type NamedResultSets struct {
+	Results map[string]interface{} `json:"results"`
+	Order   []string               `json:"order"`
+}
+
+/*
+Key each result set of a batch by name, in order. Result sets beyond the keys given are keyed by their
+position, counting from 0, and keys left without a result set are reported as warnings.
+*/
+func nameResultSets(resultSets []interface{}, keys []string, meta ResponseMeta) NamedResultSets {
+	named := NamedResultSets{
+		Results: make(map[string]interface{}, len(resultSets)),
+		Order:   make([]string, 0, len(resultSets)),
+	}
+
+	for i, resultSet := range resultSets {
+		key := strconv.Itoa(i)
+		if i < len(keys) {
+			key = keys[i]
+		} else if _, taken := named.Results[key]; taken {
+			key = fmt.Sprintf("result_%d", i)
+		}
+		named.Results[key] = resultSet
+		named.Order = append(named.Order, key)
+	}
+
+	if len(resultSets) != len(keys) {
+		addWarning(meta, fmt.Sprintf("result_keys has %d keys, but the query returned %d result sets", len(keys), len(resultSets)))
+	}
+
+	return named
+}
+
+/*
+Map each result set a query returns in turn - batches and stored procedures may return several
+*/
+func mapResultSets(rows *sql.Rows, mapSet func(rows *sql.Rows) (interface{}, error)) ([]interface{}, error) {
+	resultSets := []interface{}{}
+	for {
+		resultSet, err := mapSet(rows)
+		if err != nil {
+			return nil, err
+		}
+		resultSets = append(resultSets, resultSet)
+
+		if !rows.NextResultSet() {
+			break
+		}
+	}
+
+	return resultSets, rows.Err()
+}
+
+/*
+Map the current result set of a query, and apply the task's output options to it. Text is transcoded from
+the database's `charset`, if it isn't empty. Anything the caller should know about the result, but that
+doesn't stop it being returned, is added to the warnings in meta.
+*/
+func mapResultSet(task Task, charset string, rows *sql.Rows, meta ResponseMeta) (interface{}, error) {
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	// A FOR JSON query's output is already the document the task wants, so it is returned as it is
+	if task.AsRawJson && isForJsonResult(columnTypes) {
+		return readForJsonDocument(rows)
+	}
+
+	mapRows := mapquery.MapRows
+
+	// Decimal columns are read exactly, rather than through a float, with the other columns replayed through
+	// the mapper. A sample's rows are read the same way, as the mapper would read every row.
+	if decimals := decimalColumns(columnTypes); len(decimals) > 0 || task.Sample > 0 {
+		mapRows = func(rows *sql.Rows) ([]map[string]interface{}, error) {
+			return mapRowsExact(rows, columnTypes, decimals, task.Sample)
+		}
+	}
+
+	if jsonCols := jsonColumns(columnTypes); task.AsRawJson && len(jsonCols) > 0 {
+		mapValues := mapRows
+		mapRows = func(rows *sql.Rows) ([]map[string]interface{}, error) {
+			mappedRows, err := mapValues(rows)
+			if err == nil {
+				embedJsonValues(mappedRows, jsonCols)
+			}
+			return mappedRows, err
+		}
+	}
+
+	return mapResultSetWith(task, charset, rows, meta, mapRows)
+}
+
+/*
+Map the current result set of a query with the given row mapper, and apply the task's output options to it
+*/
+func mapResultSetWith(task Task, charset string, rows *sql.Rows, meta ResponseMeta, mapRows func(rows *sql.Rows) ([]map[string]interface{}, error)) (interface{}, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	// Checked before the rows are read, so a runaway wide select doesn't have to be mapped first
+	if getConfig().MaxColumns > 0 && len(columns) > getConfig().MaxColumns {
+		return nil, &TaskError{
+			Status: http.StatusUnprocessableEntity,
+			Code:   "too_many_columns",
+			Err:    fmt.Errorf("Result has %d columns, exceeding the limit of %d columns - select only the columns needed", len(columns), getConfig().MaxColumns),
+		}
+	}
+
+	// Taken before the rows are read, as reading the last result set to the end closes them
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	mappedRows, err := mapRows(rows)
+	if err != nil {
+		// An error the rows report came from the database or the connection, rather than converting a value
+		if rows.Err() == nil {
+			err = &MapperError{Err: err}
+		}
+		return nil, err
+	}
+	if task.Sample > 0 {
+		meta["sampled"] = true
+	}
+
+	if err := transcodeResultSet(charset, mappedRows); err != nil {
+		return nil, err
+	}
+
+	// The next cursor is taken before the values are formatted, so it can be bound as it came from the database
+	if task.CursorColumn != "" {
+		setNextCursor(task, columns, mappedRows, meta)
+	}
+
+	if getConfig().TimeFormat != "" {
+		unformatted := formatTimes(mappedRows, dateTimeColumns(columnTypes), timeLayout(getConfig().TimeFormat))
+		for _, column := range unformatted {
+			addWarning(meta, fmt.Sprintf("time_format: column %q has date/time values in a form that couldn't be read, so they were left as they are", column))
+		}
+	}
+
+	if len(task.Transforms) > 0 {
+		applyTransforms(mappedRows, task.Transforms)
+	}
+
+	if len(task.SelectColumns) > 0 {
+		var missing []string
+		columns, mappedRows, missing = selectColumns(columns, mappedRows, task.SelectColumns)
+		for _, name := range missing {
+			addWarning(meta, fmt.Sprintf("select_columns: column %q is not in the result", name))
+		}
+	}
+
+	if task.Distinct {
+		var removed int
+		mappedRows, removed, err = removeDuplicateRows(mappedRows)
+		if err != nil {
+			return nil, err
+		}
+		duplicates, _ := meta["duplicates_removed"].(int)
+		meta["duplicates_removed"] = duplicates + removed
+	}
+
+	return transformResultSet(task, columns, mappedRows), nil
+}
+
+/*
+Check a query is a single SELECT, so running it again after its result couldn't be mapped doesn't repeat
+any changes
+*/
+func isSingleSelect(query string) bool {
+	statement := strings.TrimRight(strings.TrimSpace(query), ";")
+
+	return !strings.Contains(statement, ";") && selectPattern.MatchString(statement) && !selectIntoPattern.MatchString(statement)
+}
+
+/*
+Run a query again after its result couldn't be mapped, scanning the driver's values directly and converting
+any that can't be encoded as they are to strings. The response is flagged as degraded, and lists the
+columns whose values were converted.
+*/
+func fetchDegradedResultSets(ctx context.Context, db *sql.DB, task Task, charset string, query string, args []interface{}, meta ResponseMeta) ([]interface{}, error) {
+	rows, err := queryDb(ctx, db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	coerced := make(map[string]bool)
+	resultSets, err := mapResultSets(rows, func(rows *sql.Rows) (interface{}, error) {
+		return mapResultSetWith(task, charset, rows, meta, func(rows *sql.Rows) ([]map[string]interface{}, error) {
+			return scanRowsCoerced(rows, coerced, task.Sample)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(coerced))
+	for name := range coerced {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	meta["degraded"] = true
+	meta["coerced_columns"] = names
+	if len(names) > 0 {
+		addWarning(meta, fmt.Sprintf("Values in these columns couldn't be mapped, and were returned as strings: %s", strings.Join(names, ", ")))
+	}
+
+	return resultSets, nil
+}
+
+/*
+Scan a result set into maps of column name => value without a type mapper. Values JSON can encode are
+kept as they are, and anything else is converted to a string, with its column recorded as coerced.
+With a limit, only that many rows are read.
+*/
+func scanRowsCoerced(rows *sql.Rows, coerced map[string]bool, limit int) ([]map[string]interface{}, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	result := []map[string]interface{}{}
+	for (limit <= 0 || len(result) < limit) && rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]interface{}, len(columns))
+		for i, name := range columns {
+			switch value := values[i].(type) {
+			case nil, bool, int64, float64, string, time.Time:
+				row[name] = value
+			case []byte:
+				// Text columns often arrive as bytes, so only binary data counts as coerced
+				row[name] = string(value)
+				if !utf8.Valid(value) {
+					coerced[name] = true
+				}
+			default:
+				row[name] = fmt.Sprint(value)
+				coerced[name] = true
+			}
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
+
+/*
+Transcode a result set's text from the task database's `charset`, if it has one
+*/
+func transcodeResultSet(charset string, rows []map[string]interface{}) error {
+	if charset == "" {
+		return nil
+	}
+
+	decoder, err := charsetDecoder(charset)
+	if err != nil {
+		return err
+	}
+
+	return transcodeRows(rows, decoder)
+}
+
+/*
+Find the columns of a result set holding exact numeric values, such as DECIMAL and MONEY, by position
+*/
+func decimalColumns(columnTypes []*sql.ColumnType) map[int]bool {
+	decimals := make(map[int]bool)
+	for i, columnType := range columnTypes {
+		name := strings.ToUpper(columnType.DatabaseTypeName())
+		if decimalTypes[name] {
+			decimals[i] = true
+		}
+		// Oracle uses NUMBER for integers as well, which are left to the type mapper
+		if _, scale, ok := columnType.DecimalSize(); name == "NUMBER" && ok && scale > 0 {
+			decimals[i] = true
+		}
+	}
+
+	return decimals
+}
+
+/*
+Map a result set, keeping its decimal columns exactly as the database gives them - as strings, or with a
+`decimal_format` of "number", as JSON numbers with every digit. Every other column goes through the row
+mapper as usual. With a limit, only that many rows are read - the rest are left for the driver to discard.
+*/
+func mapRowsExact(rows *sql.Rows, columnTypes []*sql.ColumnType, decimals map[int]bool, limit int) ([]map[string]interface{}, error) {
+	values, err := readRowValues(rows, columnTypes, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	mappedRows, err := mapReplayedRows(columnTypes, values, mapquery.MapRows)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, row := range mappedRows {
+		for column := range decimals {
+			row[columnTypes[column].Name()] = decimalValue(values[i][column])
+		}
+	}
+
+	return mappedRows, nil
+}
+
+/*
+Encode a decimal value in the configured `decimal_format`, without passing it through a float
+*/
+func decimalValue(value interface{}) interface{} {
+	var text string
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []byte:
+		text = string(v)
+	case string:
+		text = v
+	case float64:
+		text = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		text = fmt.Sprint(v)
+	}
+
+	if getConfig().DecimalFormat == DECIMAL_FORMAT_NUMBER {
+		return json.Number(strings.TrimSpace(text))
+	}
+
+	return text
+}
+
+/*
+Apply each column's named transform to its values, in place. Columns are named as the database returns them.
+*/
+func applyTransforms(rows []map[string]interface{}, transforms map[string]string) {
+	for _, row := range rows {
+		for column, name := range transforms {
+			if value, ok := row[column]; ok {
+				row[column] = columnTransforms[name](value)
+			}
+		}
+	}
+}
+
+/*
+Build a transform that applies a string function to text values, leaving other values alone
+*/
+func transformString(transform func(string) string) func(value interface{}) interface{} {
+	return func(value interface{}) interface{} {
+		switch v := value.(type) {
+		case string:
+			return transform(v)
+		case []byte:
+			return transform(string(v))
+		}
+		return value
+	}
+}
+
+/*
+Format a date/time value, or text in a common date/time format, as ISO 8601 e.g. "2016-05-17T01:02:03Z".
+Values that aren't dates are left alone.
+*/
+func transformIso8601(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []byte:
+		return transformIso8601(string(v))
+	case string:
+		if t, ok := parseDateTime(v); ok {
+			return t.Format(time.RFC3339Nano)
+		}
+	}
+
+	return value
+}
+
+/*
+Parse text in one of the date/time formats databases return as text
+*/
+func parseDateTime(text string) (time.Time, bool) {
+	for _, layout := range dateTimeLayouts {
+		if t, err := time.Parse(layout, strings.TrimSpace(text)); err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+/*
+The Go layout for a configured `time_format` - "rfc3339", "rfc3339nano", or a layout of its own e.g. "2006-01-02 15:04:05"
+*/
+func timeLayout(timeFormat string) string {
+	switch strings.ToLower(timeFormat) {
+	case TIME_FORMAT_RFC3339:
+		return time.RFC3339
+	case TIME_FORMAT_RFC3339_NANO:
+		return time.RFC3339Nano
+	}
+
+	return timeFormat
+}
+
+/*
+Find the columns of a result set whose type is a date or time, by name
+*/
+func dateTimeColumns(columnTypes []*sql.ColumnType) map[string]bool {
+	columns := map[string]bool{}
+	for _, columnType := range columnTypes {
+		if dateTimeTypes[strings.ToUpper(columnType.DatabaseTypeName())] {
+			columns[columnType.Name()] = true
+		}
+	}
+
+	return columns
+}
+
+/*
+Format the date/time values in a result set as strings with the given layout, in place, so dates read the
+same whichever database or driver they came from. Drivers that return dates as text, such as MySQL without
+`parseTime` and SQLite, have the text of date/time columns parsed first. The date/time columns with text
+that couldn't be parsed are returned, so the caller can be told.
+*/
+func formatTimes(rows []map[string]interface{}, dateTimeCols map[string]bool, layout string) []string {
+	unparsed := map[string]bool{}
+	formatText := func(row map[string]interface{}, column string, text string) {
+		if !dateTimeCols[column] {
+			return
+		}
+		if t, ok := parseDateTime(text); ok {
+			row[column] = t.Format(layout)
+		} else {
+			unparsed[column] = true
+		}
+	}
+
+	for _, row := range rows {
+		for column, value := range row {
+			switch v := value.(type) {
+			case time.Time:
+				row[column] = v.Format(layout)
+			case *time.Time:
+				if v != nil {
+					row[column] = v.Format(layout)
+				}
+			case []byte:
+				formatText(row, column, string(v))
+			case string:
+				formatText(row, column, v)
+			}
+		}
+	}
+
+	columns := make([]string, 0, len(unparsed))
+	for column := range unparsed {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	return columns
+}
+
+/*
+Keep only the selected columns of a result set, matching names without regard to case. Selected names
+that aren't in the result are returned, so the caller can be told.
+*/
+func selectColumns(columns []string, rows []map[string]interface{}, selected []string) ([]string, []map[string]interface{}, []string) {
+	kept := []string{}
+	missing := []string{}
+
+	for _, name := range selected {
+		found := false
+		for _, column := range columns {
+			if strings.EqualFold(column, name) {
+				kept = append(kept, column)
+				found = true
+			}
+		}
+		if !found {
+			missing = append(missing, name)
+		}
+	}
+
+	for i, row := range rows {
+		selectedRow := make(map[string]interface{}, len(kept))
+		for _, column := range kept {
+			if value, ok := row[column]; ok {
+				selectedRow[column] = value
+			}
+		}
+		rows[i] = selectedRow
+	}
+
+	return kept, rows, missing
+}
+
+/*
+Remove rows whose values exactly match an earlier row, keeping the first of each. Rows are compared by a hash
+of their JSON encoding, which lists columns in a fixed order. Returns the rows kept and how many were removed.
+*/
+func removeDuplicateRows(rows []map[string]interface{}) ([]map[string]interface{}, int, error) {
+	seen := make(map[[sha256.Size]byte]bool, len(rows))
+	kept := rows[:0]
+
+	for _, row := range rows {
+		encoded, err := json.Marshal(row)
+		if err != nil {
+			return nil, 0, err
+		}
+		hash := sha256.Sum256(encoded)
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		kept = append(kept, row)
+	}
+
+	return kept, len(rows) - len(kept), nil
+}
+
+/*
+Add a warning to a response's meta, to be returned alongside the result
+*/
+func addWarning(meta ResponseMeta, warning string) {
+	warnings, _ := meta["warnings"].([]string)
+	meta["warnings"] = append(warnings, warning)
+}
+
+/*
+Apply the task's output options to a result set fetched from the database
+*/
+func transformResultSet(task Task, columns []string, rows []map[string]interface{}) interface{} {
+	fieldCase := getConfig().FieldCase
+	if fieldCase == FIELD_CASE_AS_IS {
+		fieldCase = ""
+	}
+
+	if len(task.ColumnMap) > 0 || fieldCase != "" {
+		rows = renameColumns(rows, task.ColumnMap, fieldCase)
+		for i, name := range columns {
+			columns[i] = renameColumn(name, task.ColumnMap, fieldCase)
+		}
+	}
+
+	if task.OutputFormat == OUTPUT_FORMAT_COLUMNAR {
+		return transposeResultSet(columns, rows)
+	}
+
+	return rows
+}
+
+/*
+Transpose rows into a ColumnarResultSet e.g. [{"a": 1, "b": 2}, {"a": 3, "b": 4}] => {"a": [1, 3], "b": [2, 4]}
+*/
+func transposeResultSet(columns []string, rows []map[string]interface{}) ColumnarResultSet {
+	resultSet := ColumnarResultSet{
+		Columns: []string{},
+		Data:    make(map[string][]interface{}, len(columns)),
+	}
+
+	// A name used by more than one column only holds one value in each row, so is only listed once
+	for _, name := range columns {
+		if _, ok := resultSet.Data[name]; ok {
+			continue
+		}
+		values := make([]interface{}, len(rows))
+		for i, row := range rows {
+			values[i] = row[name]
+		}
+		resultSet.Columns = append(resultSet.Columns, name)
+		resultSet.Data[name] = values
+	}
+
+	return resultSet
+}
+
+/*
+Rename columns according to a map of old name => new name. Other columns are converted to the
+field case, if one is given, or passed through unchanged.
+*/
+func renameColumns(rows []map[string]interface{}, columnMap map[string]string, fieldCase string) []map[string]interface{} {
+	// Every row has the same columns, so each name only needs converting once
+	names := make(map[string]string)
+
+	for i, row := range rows {
+		renamed := make(map[string]interface{}, len(row))
+		for name, value := range row {
+			newName, ok := names[name]
+			if !ok {
+				newName = renameColumn(name, columnMap, fieldCase)
+				names[name] = newName
+			}
+			renamed[newName] = value
+		}
+		rows[i] = renamed
+	}
+
+	return rows
+}
+
+/*
+Get the new name for a column from the column map, or by converting it to the field case
+*/
+func renameColumn(name string, columnMap map[string]string, fieldCase string) string {
+	if newName, ok := columnMap[name]; ok {
+		return newName
+	}
+
+	return convertFieldCase(name, fieldCase)
+}
+
+/*
+Convert a column name to snake_case or camelCase e.g. "StudentName" => "student_name" or "studentName".
+Any other field case leaves the name as it is.
+*/
+func convertFieldCase(name string, fieldCase string) string {
+	if fieldCase != FIELD_CASE_SNAKE && fieldCase != FIELD_CASE_CAMEL {
+		return name
+	}
+
+	words := splitFieldWords(name)
+	if len(words) == 0 {
+		return name
+	}
+
+	for i, word := range words {
+		letters := []rune(strings.ToLower(word))
+		if fieldCase == FIELD_CASE_CAMEL && i > 0 {
+			letters[0] = unicode.ToUpper(letters[0])
+		}
+		words[i] = string(letters)
+	}
+
+	if fieldCase == FIELD_CASE_SNAKE {
+		return strings.Join(words, "_")
+	}
+
+	return strings.Join(words, "")
+}
+
+/*
+Split a column name into words at separators and case changes, keeping acronyms together
+e.g. "StudentID" => ["Student", "ID"], "HTTPStatus" => ["HTTP", "Status"], "year_level" => ["year", "level"]
+*/
+func splitFieldWords(name string) []string {
+	words := []string{}
+	runes := []rune(name)
+	start := -1
+
+	for i, r := range runes {
+		if r == '_' || r == '-' || r == ' ' {
+			if start >= 0 {
+				words = append(words, string(runes[start:i]))
+				start = -1
+			}
+			continue
+		}
+
+		if start >= 0 && unicode.IsUpper(r) {
+			previous := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(previous) || unicode.IsDigit(previous) || (unicode.IsUpper(previous) && nextIsLower) {
+				words = append(words, string(runes[start:i]))
+				start = i
+			}
+		}
+
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		words = append(words, string(runes[start:]))
+	}
+
+	return words
+}
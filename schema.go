@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+Rules a task of one type must follow, from the `task_schemas` config. Fields are named as in the task's JSON,
+with dots for fields of nested objects e.g. "config.dsn".
+*/
+type TaskSchema struct {
+	Required []string          `json:"required"` // Fields that must be given, with a value that isn't null or empty
+	Types    map[string]string `json:"types"`    // Field => JSON type its value must have, if given - "string", "number", "integer", "boolean", "array" or "object"
+}
+
+/*
+Check a task's JSON against the configured schema for its type, returning each rule it breaks. Tasks of a type
+with no schema always pass.
+*/
+func checkTaskSchema(taskType string, data []byte) []string {
+	schema, ok := getConfig().TaskSchemas[taskType]
+	if !ok {
+		return nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return []string{fmt.Sprintf("task is not a JSON object: %s", err)}
+	}
+
+	var failures []string
+	for _, name := range schema.Required {
+		if value, ok := lookupTaskField(fields, name); !ok || isEmptyJson(value) {
+			failures = append(failures, fmt.Sprintf("%s is required for %s tasks", name, taskType))
+		}
+	}
+
+	// Sorted, so the failures come back in the same order every time
+	names := make([]string, 0, len(schema.Types))
+	for name := range schema.Types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value, ok := lookupTaskField(fields, name)
+		if !ok || bytes.Equal(value, []byte("null")) {
+			continue
+		}
+		want := schema.Types[name]
+		got := jsonType(value)
+		if want == got || (want == "number" && got == "integer") {
+			continue
+		}
+		switch want {
+		case "string", "number", "integer", "boolean", "array", "object":
+			failures = append(failures, fmt.Sprintf("%s must be of type %s for %s tasks, not %s", name, want, taskType, got))
+		default:
+			failures = append(failures, fmt.Sprintf("task_schemas: %s has an unknown type %q for %s tasks", name, want, taskType))
+		}
+	}
+
+	return failures
+}
+
+/*
+Find a field in a task's JSON by its dotted name
+*/
+func lookupTaskField(fields map[string]json.RawMessage, name string) (json.RawMessage, bool) {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		value, ok := fields[part]
+		if !ok {
+			return nil, false
+		}
+		if i == len(parts)-1 {
+			return value, true
+		}
+		fields = nil
+		if err := json.Unmarshal(value, &fields); err != nil {
+			return nil, false
+		}
+	}
+
+	return nil, false
+}
+
+/*
+Check whether a JSON value is null, or an empty string, array or object
+*/
+func isEmptyJson(value json.RawMessage) bool {
+	switch string(bytes.Join(bytes.Fields(value), nil)) {
+	case "null", `""`, "[]", "{}":
+		return true
+	}
+
+	return false
+}
+
+/*
+Name the JSON type of a value, telling integers apart from other numbers
+*/
+func jsonType(value json.RawMessage) string {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 {
+		return "null"
+	}
+
+	switch value[0] {
+	case '"':
+		return "string"
+	case '[':
+		return "array"
+	case '{':
+		return "object"
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	}
+
+	if bytes.ContainsAny(value, ".eE") {
+		return "number"
+	}
+
+	return "integer"
+}
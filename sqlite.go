@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+const (
+	SQLITE_MEMORY_DSN = ":memory:"
+)
+
+var (
+	// Statements that would let a test database read or write files on the connector's host
+	sqliteFileStatementPattern = regexp.MustCompile(`(?i)\b(ATTACH|VACUUM)\b`)
+)
+
+/*
+Open a fresh in-memory SQLite database for a `sqlite.query` task, and run the task's `seed_statements` to
+populate it. Each task gets a database of its own, which is gone once the task has finished with it.
+*/
+func openSqliteTestDb(ctx context.Context, task Task) (*sql.DB, error) {
+	dbConfig, err := getTaskDbConfig(task)
+	if err != nil {
+		return nil, err
+	}
+	if dbConfig.Dsn != SQLITE_MEMORY_DSN {
+		return nil, newDbConfigError(fmt.Errorf("SQLite tasks only run against in-memory databases, with the dsn %q", SQLITE_MEMORY_DSN))
+	}
+
+	for _, statement := range append([]string{task.Payload}, task.SeedStatements...) {
+		if sqliteFileStatementPattern.MatchString(statement) {
+			return nil, &TaskError{
+				Status: http.StatusBadRequest,
+				Err:    fmt.Errorf("ATTACH and VACUUM can't be used against a SQLite test database"),
+			}
+		}
+	}
+
+	db, err := sql.Open("sqlite", SQLITE_MEMORY_DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every connection to :memory: is a separate database, so the seed and the query must share one
+	db.SetMaxOpenConns(1)
+
+	for i, statement := range task.SeedStatements {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("seed_statements[%d] failed: %s", i, err)
+		}
+	}
+
+	return db, nil
+}
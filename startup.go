@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	STARTUP_DB_WAIT        = 300             // Seconds to wait for the configured databases at startup
+	STARTUP_RETRY_INTERVAL = 5 * time.Second // Delay between rounds of startup database pings
+	STARTUP_RETRY_AFTER    = 10              // Seconds clients are asked to wait before retrying a task during startup
+)
+
+var (
+	startingUp int32 // Non-zero until the startup delay and database wait are over, set atomically
+)
+
+/*
+Check whether the connector is still starting up, and not yet running tasks
+*/
+func isStarting() bool {
+	return atomic.LoadInt32(&startingUp) != 0
+}
+
+/*
+Hold tasks back until the connector is ready - after `startup_delay_seconds`, and with `wait_for_db_on_start`,
+until every configured database responds or `wait_for_db_timeout_seconds` passes. The wait runs in the
+background while the server listens, so /health can report that the connector is starting rather than
+appearing down.
+*/
+func startReadinessGate() {
+	if getConfig().StartupDelaySeconds <= 0 && !getConfig().WaitForDbOnStart {
+		return
+	}
+
+	// Set before the server starts, so no task slips in ahead of the wait
+	atomic.StoreInt32(&startingUp, 1)
+
+	go func() {
+		defer atomic.StoreInt32(&startingUp, 0)
+		awaitStartup()
+	}()
+}
+
+/*
+Wait out the startup delay, then for the configured databases if the config asks for it
+*/
+func awaitStartup() {
+	if getConfig().StartupDelaySeconds > 0 {
+		svcLogger.Infof("Waiting %d seconds before running tasks", getConfig().StartupDelaySeconds)
+		time.Sleep(time.Duration(getConfig().StartupDelaySeconds) * time.Second)
+	}
+
+	if !getConfig().WaitForDbOnStart {
+		return
+	}
+
+	deadline := time.Now().Add(configSeconds(getConfig().WaitForDbTimeoutSeconds, STARTUP_DB_WAIT))
+	for {
+		err := pingConfiguredDatabases()
+		if err == nil {
+			svcLogger.Info("Configured databases are available, ready to run tasks")
+			return
+		}
+		if time.Now().After(deadline) {
+			svcLogger.Warningf("Gave up waiting for databases at startup, running tasks anyway: %s", err)
+			return
+		}
+
+		svcLogger.Infof("Waiting for databases at startup: %s", err)
+		time.Sleep(STARTUP_RETRY_INTERVAL)
+	}
+}
+
+/*
+Ping every database in the connector's config, returning the first that doesn't respond
+*/
+func pingConfiguredDatabases() error {
+	for name, dbConfig := range getConfig().Databases {
+		dbConfig = resolveDsnTemplates(dbConfig)
+		if dbConfig.Type == "" {
+			dbConfig.Type = getConfig().DefaultDbType
+		}
+		if dbConfig.Dsn == "" && len(dbConfig.Dsns) > 0 {
+			dbConfig.Dsn = dbConfig.Dsns[0]
+		}
+
+		dbConfig, err := applySshTunnel(dbConfig)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		db, err := getDbPool(dbConfig)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		if err := pingDb(context.Background(), db, DB_CONNECT_TIMEOUT*time.Second); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+/*
+Error returned for a task received before the connector is ready
+*/
+func newStartingError() *TaskError {
+	return &TaskError{
+		Status: http.StatusServiceUnavailable,
+		Code:   "starting",
+		Err:    fmt.Errorf("The connector is starting up, please try again shortly"),
+	}
+}
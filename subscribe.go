@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	SUBSCRIBE_HEARTBEAT     = 30 * time.Second // Interval between heartbeat events, which also check the connection
+	SUBSCRIBE_RETRY_MS      = 5000             // Milliseconds an EventSource client should wait before reconnecting
+	SUBSCRIBE_MIN_RECONNECT = 10 * time.Second
+	SUBSCRIBE_MAX_RECONNECT = time.Minute
+)
+
+/*
+A notification received on a subscribed channel
+*/
+type DbNotification struct {
+	Channel string `json:"channel"`
+	Payload string `json:"payload"`
+	Pid     int    `json:"pid"` // Server process ID of the session that sent the notification
+}
+
+/*
+Handle an HTTP request to the /subscribe URL - LISTEN on the Postgres channel named in a `postgres.subscribe`
+task's payload, streaming each notification to the client as a Server-Sent Event until the client disconnects
+or the task is cancelled
+*/
+func handleSubscribe(w http.ResponseWriter, r *http.Request) {
+
+	if rejectForMaintenance(w, r) {
+		return
+	}
+
+	started := time.Now()
+
+	task, err := parseSubscribeRequest(r)
+	if err != nil {
+		writeAuditEntry(task, clientIP(r), nil, started, err)
+		status := http.StatusBadRequest
+		if taskErr, ok := err.(*TaskError); ok {
+			status = taskErr.Status
+		}
+		writeResponse(w, r, status, JsonResponse{
+			Type: "error",
+			Body: err.Error(),
+		})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeResponse(w, r, http.StatusInternalServerError, JsonResponse{
+			Type: "error",
+			Body: "Streaming is not supported",
+		})
+		return
+	}
+
+	dbConfig, err := getTaskDbConfig(task)
+	if err == nil {
+		dbConfig, err = applySshTunnel(dbConfig)
+	}
+	if err != nil {
+		writeAuditEntry(task, clientIP(r), nil, started, err)
+		writeResponse(w, r, http.StatusInternalServerError, JsonResponse{
+			Type: "error",
+			Body: fmt.Sprintf("Database error: %s", err),
+		})
+		return
+	}
+
+	listener := pq.NewListener(withApplicationName(dbConfig.Type, dbConfig.Dsn), SUBSCRIBE_MIN_RECONNECT, SUBSCRIBE_MAX_RECONNECT, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			svcLogger.Warningf("Subscription %s connection problem: %s", task.Id, err)
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen(task.Payload); err != nil {
+		writeAuditEntry(task, clientIP(r), nil, started, err)
+		writeResponse(w, r, http.StatusInternalServerError, JsonResponse{
+			Type: "error",
+			Body: fmt.Sprintf("Database error: %s", err),
+		})
+		return
+	}
+
+	// Track the subscription like any other task, so it can be ended through the /cancel endpoint
+	// The stream's own disconnect handling ends it when the client goes, so it isn't tied to the request here
+	ctx, done := trackTask(context.Background(), task.Id)
+	defer done()
+
+	svcLogger.Infof("Subscription %s listening on channel %s", task.Id, task.Payload)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// Tell EventSource clients how long to wait before reconnecting if the stream is dropped
+	fmt.Fprintf(w, "retry: %d\n\n", SUBSCRIBE_RETRY_MS)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(SUBSCRIBE_HEARTBEAT)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			err = nil
+		case <-ctx.Done():
+			err = newCancelledError(task.Id)
+		case notification := <-listener.Notify:
+			// A nil notification means the connection was lost and re-established - anything sent meanwhile was missed
+			if notification == nil {
+				err = writeEvent(w, flusher, "reconnected", map[string]interface{}{"channel": task.Payload})
+			} else {
+				err = writeEvent(w, flusher, "notification", DbNotification{
+					Channel: notification.Channel,
+					Payload: notification.Extra,
+					Pid:     notification.BePid,
+				})
+			}
+			if err == nil {
+				continue
+			}
+		case <-heartbeat.C:
+			go listener.Ping()
+			err = writeEvent(w, flusher, "heartbeat", map[string]interface{}{"time": time.Now().UTC()})
+			if err == nil {
+				continue
+			}
+		}
+
+		svcLogger.Infof("Subscription %s ended", task.Id)
+		writeAuditEntry(task, clientIP(r), nil, started, err)
+		return
+	}
+}
+
+/*
+Read and validate a subscribe task from the request body
+*/
+func parseSubscribeRequest(r *http.Request) (Task, error) {
+
+	var task Task
+
+	if r.Method != http.MethodPost {
+		return task, &TaskError{
+			Status: http.StatusMethodNotAllowed,
+			Err:    fmt.Errorf("Subscriptions must be requested with POST"),
+		}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		return task, err
+	}
+
+	task, err = parseTask(body)
+	if err != nil {
+		return task, err
+	}
+
+	if task.Type != TASK_TYPE_DB_SUBSCRIBE {
+		return task, fmt.Errorf("Only %s tasks can be made through /subscribe", TASK_TYPE_DB_SUBSCRIBE)
+	}
+	if err := checkTaskTypeEnabled(task.Type); err != nil {
+		return task, err
+	}
+	dbConfig, err := getTaskDbConfig(task)
+	if err != nil {
+		return task, err
+	}
+	if dbConfig.Type != "postgres" {
+		return task, fmt.Errorf("Subscriptions are not supported for database type: %s", dbConfig.Type)
+	}
+
+	return task, nil
+}
+
+/*
+Write a Server-Sent Event with a JSON encoded body, sending it to the client immediately
+*/
+func writeEvent(w io.Writer, flusher http.Flusher, event string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, encoded); err != nil {
+		return err
+	}
+	flusher.Flush()
+
+	return nil
+}
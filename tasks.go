@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	STATUS_CLIENT_CLOSED_REQUEST = 499 // Non-standard status for a request the client gave up on before the response, as nginx logs it
+)
+
+var (
+	runningTasks     = make(map[string]*runningTask) // In-flight tasks keyed by task ID
+	runningTasksLock sync.Mutex
+)
+
+/*
+A task that is currently being processed, which can be cancelled
+*/
+type runningTask struct {
+	cancel context.CancelFunc
+}
+
+/*
+Register a task as running, returning the context its database calls should use and
+a function to call once the task has finished. The context ends with the parent's, as well as on cancellation.
+*/
+func trackTask(parent context.Context, id string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	task := &runningTask{cancel: cancel}
+
+	runningTasksLock.Lock()
+	runningTasks[id] = task
+	runningTasksLock.Unlock()
+
+	return ctx, func() {
+		runningTasksLock.Lock()
+		if runningTasks[id] == task {
+			delete(runningTasks, id)
+		}
+		runningTasksLock.Unlock()
+
+		cancel()
+	}
+}
+
+/*
+Cancel a running task, aborting any database call in progress. Returns false if no task with the ID is running.
+*/
+func cancelTask(id string) bool {
+	runningTasksLock.Lock()
+	task, ok := runningTasks[id]
+	runningTasksLock.Unlock()
+
+	if ok {
+		task.cancel()
+	}
+
+	return ok
+}
+
+/*
+Cancel every running task, returning how many there were
+*/
+func cancelAllTasks() int {
+	runningTasksLock.Lock()
+	tasks := make([]*runningTask, 0, len(runningTasks))
+	for _, task := range runningTasks {
+		tasks = append(tasks, task)
+	}
+	runningTasksLock.Unlock()
+
+	for _, task := range tasks {
+		task.cancel()
+	}
+
+	return len(tasks)
+}
+
+/*
+Handle an HTTP request to the /cancel/{id} URL - cancel the running task with the given ID
+*/
+func handleCancel(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		writeResponse(w, r, http.StatusMethodNotAllowed, JsonResponse{
+			Type: "error",
+			Body: "Task cancellation must be requested with POST",
+		})
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/cancel/")
+	if id == "" {
+		writeResponse(w, r, http.StatusBadRequest, JsonResponse{
+			Type: "error",
+			Body: "A task ID is required e.g. /cancel/573a6ec5cd45b",
+		})
+		return
+	}
+
+	cancelled := cancelTask(id)
+	if cancelled {
+		svcLogger.Infof("Task cancelled: %s", id)
+	}
+
+	writeResponse(w, r, http.StatusOK, JsonResponse{
+		Type: "success",
+		Body: map[string]interface{}{
+			"id":        id,
+			"cancelled": cancelled,
+		},
+	})
+}
+
+/*
+Error returned for a task that was cancelled while it was running
+*/
+func newCancelledError(id string) *TaskError {
+	return &TaskError{
+		Status: http.StatusInternalServerError,
+		Code:   "task_cancelled",
+		Err:    fmt.Errorf("Task cancelled: %s", id),
+	}
+}
+
+/*
+Build the error for a task abandoned because the client that requested it disconnected. Nobody receives
+the response, but the status and code are recorded in the audit log and metrics.
+*/
+func newClientDisconnectedError(id string) *TaskError {
+	return &TaskError{
+		Status: STATUS_CLIENT_CLOSED_REQUEST,
+		Code:   "client_disconnected",
+		Err:    fmt.Errorf("Task abandoned, the client disconnected: %s", id),
+	}
+}
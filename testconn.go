@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	TEST_CONNECTION_TIMEOUT = 5 // Seconds allowed to connect and read the server version when testing a DSN
+)
+
+/*
+The outcome of testing a database config with /admin/test-connection
+*/
+type TestConnectionResult struct {
+	Connected bool    `json:"connected"`
+	Type      string  `json:"type"`
+	Version   string  `json:"version,omitempty"`
+	LatencyMs float64 `json:"latency_ms,omitempty"` // Time taken to connect and read the version
+	Error     string  `json:"error,omitempty"`      // Why the connection failed, with any credentials removed
+}
+
+/*
+Handle an HTTP request to the /admin/test-connection URL - check a database config works, by connecting
+and reading the server version, without running a task. Nothing from the DSN is sent back.
+*/
+func handleTestConnection(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		writeResponse(w, r, http.StatusMethodNotAllowed, JsonResponse{
+			Type: "error",
+			Body: "Testing a connection must be requested with POST",
+		})
+		return
+	}
+
+	var dbConfig TaskDbConfig
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err == nil {
+		err = json.Unmarshal(body, &dbConfig)
+	}
+	if err == nil && dbConfig.Dsn == "" && len(dbConfig.Dsns) == 0 {
+		err = fmt.Errorf("a dsn is required")
+	}
+	if err != nil {
+		writeResponse(w, r, http.StatusBadRequest, JsonResponse{
+			Type: "error",
+			Body: fmt.Sprintf("Invalid test connection request: %s", err),
+		})
+		return
+	}
+
+	if dbConfig.Type == "" {
+		dbConfig.Type = getConfig().DefaultDbType
+	}
+	if dbConfig.Dsn == "" {
+		dbConfig.Dsn = dbConfig.Dsns[0]
+	}
+
+	result := testConnection(r.Context(), dbConfig)
+	if result.Connected {
+		svcLogger.Infof("Test connection to a %s database succeeded", dbConfig.Type)
+	} else {
+		svcLogger.Warningf("Test connection to a %s database failed: %s", dbConfig.Type, result.Error)
+	}
+
+	writeResponse(w, r, http.StatusOK, JsonResponse{
+		Type: "success",
+		Body: result,
+	})
+}
+
+/*
+Open a connection of its own to a database, outside the pools, and read the server version
+*/
+func testConnection(ctx context.Context, dbConfig TaskDbConfig) TestConnectionResult {
+	result := TestConnectionResult{Type: dbConfig.Type}
+
+	fail := func(err error) TestConnectionResult {
+		result.Error = redactDsnSecrets(err.Error(), dbConfig.Type, dbConfig.Dsn)
+		return result
+	}
+
+	query, ok := diagnosticQueries[dbConfig.Type]
+	if !ok {
+		return fail(fmt.Errorf("Unsupported database type: %s", dbConfig.Type))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, TEST_CONNECTION_TIMEOUT*time.Second)
+	defer cancel()
+
+	started := time.Now()
+
+	tunnelled, err := applySshTunnel(dbConfig)
+	if err != nil {
+		return fail(err)
+	}
+
+	db, err := openDb(tunnelled)
+	if err != nil {
+		return fail(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if err := pingDb(ctx, db, TEST_CONNECTION_TIMEOUT*time.Second); err != nil {
+		return fail(err)
+	}
+
+	// The current database is NULL when the DSN doesn't name one
+	var version, database sql.NullString
+	if err := db.QueryRowContext(ctx, query).Scan(&version, &database); err != nil {
+		return fail(err)
+	}
+
+	result.Connected = true
+	result.LatencyMs = float64(time.Since(started).Microseconds()) / 1000
+	result.Version = version.String
+
+	return result
+}
+
+/*
+Remove a DSN, and the password in it, from an error message - drivers may quote either when they fail
+*/
+func redactDsnSecrets(message string, dbType string, dsn string) string {
+	secrets := []string{dsn}
+
+	switch {
+	case dbType == "mysql" || dbType == "mariadb":
+		if dsnConfig, err := mysql.ParseDSN(dsn); err == nil {
+			secrets = append(secrets, dsnConfig.Passwd)
+		}
+	case strings.Contains(dsn, "://"):
+		if dsnUrl, err := url.Parse(dsn); err == nil && dsnUrl.User != nil {
+			password, _ := dsnUrl.User.Password()
+			secrets = append(secrets, password)
+		}
+	default:
+		// ADO style DSN e.g. "server=db;user id=sa;password=secret"
+		for _, part := range strings.Split(dsn, ";") {
+			pair := strings.SplitN(part, "=", 2)
+			if len(pair) != 2 {
+				continue
+			}
+			switch strings.ToLower(strings.TrimSpace(pair[0])) {
+			case "password", "pwd":
+				secrets = append(secrets, strings.TrimSpace(pair[1]))
+			}
+		}
+	}
+
+	for _, secret := range secrets {
+		if secret != "" {
+			message = strings.Replace(message, secret, REDACTED, -1)
+		}
+	}
+
+	return message
+}
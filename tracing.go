@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+const (
+	TRACING_SERVICE_NAME     = "digistorm-connector"
+	TRACING_SHUTDOWN_TIMEOUT = 5 * time.Second
+)
+
+var (
+	tracer         = otel.Tracer("github.com/markokeeffe/connector") // Spans are dropped until an exporter is configured
+	tracerProvider *sdktrace.TracerProvider
+)
+
+/*
+Start exporting spans over OTLP/HTTP to the configured collector. Without a collector endpoint,
+tracing stays disabled and spans cost next to nothing.
+*/
+func initTracing() error {
+	if getConfig().OtlpEndpoint == "" {
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(getConfig().OtlpEndpoint))
+	if err != nil {
+		return err
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(sdkresource.NewSchemaless(semconv.ServiceName(TRACING_SERVICE_NAME))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	svcLogger.Infof("Exporting traces to %s", getConfig().OtlpEndpoint)
+
+	return nil
+}
+
+/*
+Flush any spans still waiting to be exported
+*/
+func shutdownTracing() {
+	if tracerProvider == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), TRACING_SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	errCheck(tracerProvider.Shutdown(ctx))
+}
+
+/*
+Start a span as a child of the caller's trace, as given by the request's `traceparent` header
+*/
+func startRequestSpan(ctx context.Context, carrier propagation.HeaderCarrier, name string) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+}
+
+/*
+Describe the task a span covers
+*/
+func setTaskSpanAttributes(span trace.Span, task Task) {
+	// A task with an unusable config fails before it reaches the database, so is described without one
+	dbConfig, _ := getTaskDbConfig(task)
+	dbType := dbConfig.Type
+
+	span.SetAttributes(
+		attribute.String("task.id", task.Id),
+		attribute.String("task.type", task.Type),
+		attribute.String("db.system", dbType),
+		attribute.String("db.driver", dbDriverName(dbType)),
+	)
+}
+
+/*
+Mark a span as failed, if the work it covers returned an error
+*/
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+Log a step of a task that asked for `verbose` logging. Nothing is logged for other tasks.
+*/
+func logVerbose(task Task, format string, args ...interface{}) {
+	if !task.Verbose {
+		return
+	}
+
+	svcLogger.Infof("[verbose] Task %s: %s", task.Id, fmt.Sprintf(format, args...))
+}
+
+/*
+Log what a verbose task is about to run - its statement and params, unless `redact_verbose_logs` keeps them
+out of the logs whatever tasks ask for
+*/
+func logVerboseStart(task Task) {
+	if !task.Verbose {
+		return
+	}
+
+	logVerbose(task, "%s against %q", task.Type, taskDbLabel(task))
+	if getConfig().RedactVerboseLogs {
+		logVerbose(task, "statement and params redacted by redact_verbose_logs")
+		return
+	}
+
+	logVerbose(task, "statement: %s", task.Payload)
+	if len(task.Params) > 0 {
+		logVerbose(task, "params: %s", task.Params)
+	}
+	if len(task.ParamTypes) > 0 {
+		logVerbose(task, "param_types: %s", strings.Join(task.ParamTypes, ", "))
+	}
+	for _, param := range task.ProcParams {
+		logVerbose(task, "proc param: %+v", param)
+	}
+	if len(task.Rows) > 0 {
+		logVerbose(task, "bulk insert of %d rows into columns: %s", len(task.Rows), strings.Join(task.Columns, ", "))
+	}
+}
+
+/*
+Log how a verbose task finished - how long it took, the rows it returned or affected and any warnings or error
+*/
+func logVerboseEnd(task Task, started time.Time, response interface{}, meta ResponseMeta, err error) {
+	if !task.Verbose {
+		return
+	}
+
+	elapsed := time.Since(started).Milliseconds()
+	if err != nil {
+		logVerbose(task, "failed after %dms: %s", elapsed, err)
+		return
+	}
+
+	logVerbose(task, "finished in %dms, %d rows", elapsed, countResultRows(response))
+	if warnings, ok := meta["warnings"].([]string); ok {
+		for _, warning := range warnings {
+			logVerbose(task, "warning: %s", warning)
+		}
+	}
+}
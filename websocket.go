@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WS_MAX_CONCURRENT_TASKS = 8       // Tasks from one WebSocket connection processed at the same time
+	WS_MAX_MESSAGE_BYTES    = 1048576 // Largest task message accepted, matching the /task request body limit
+)
+
+var (
+	wsUpgrader = websocket.Upgrader{CheckOrigin: checkWsOrigin}
+)
+
+/*
+A task response sent over a WebSocket, tagged with the ID of the task it answers
+*/
+type WsResponse struct {
+	Id string `json:"id"`
+	JsonResponse
+}
+
+/*
+Handle an HTTP request to the /ws URL - upgrade to a WebSocket that takes JSON encoded tasks as messages and
+answers each with a JsonResponse message tagged with the task ID. Tasks are processed concurrently, so
+responses may arrive in a different order to their tasks.
+*/
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+
+	// The upgrade writes its own error response
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		errCheck(err)
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadLimit(WS_MAX_MESSAGE_BYTES)
+	ip := clientIP(r)
+
+	svcLogger.Infof("WebSocket connection opened from %s", ip)
+
+	// Only one goroutine may write to the connection at a time
+	var writeLock sync.Mutex
+	send := func(response WsResponse) {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+
+		errCheck(conn.WriteJSON(response))
+	}
+
+	// Let running tasks finish and send their responses before the connection is closed
+	var running sync.WaitGroup
+	defer running.Wait()
+
+	slots := make(chan struct{}, WS_MAX_CONCURRENT_TASKS)
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			svcLogger.Infof("WebSocket connection from %s closed: %s", ip, err)
+			return
+		}
+
+		slots <- struct{}{}
+		running.Add(1)
+		go func(message []byte) {
+			defer func() {
+				<-slots
+				running.Done()
+			}()
+
+			send(processWsMessage(r, ip, message))
+		}(message)
+	}
+}
+
+/*
+Accept WebSocket upgrades from the connector's own origin, as the upgrader does by default, and from any
+of the configured `allowed_origins`
+*/
+func checkWsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(getConfig().AllowedOrigins) > 0 && isAllowedOrigin(origin) {
+		return true
+	}
+
+	originURL, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(originURL.Host, r.Host)
+}
+
+/*
+Process a task received over a WebSocket, building the response to send back
+*/
+func processWsMessage(r *http.Request, ip string, message []byte) (response WsResponse) {
+
+	// A panic in a driver or while mapping results shouldn't take the connection down without a response
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			svcLogger.Errorf("Panic while processing task: %v\n%s", recovered, debug.Stack())
+			response.JsonResponse = JsonResponse{
+				Type: "error",
+				Body: fmt.Sprintf("Internal error: %v", recovered),
+				Code: "panic",
+			}
+		}
+	}()
+
+	if inMaintenance() {
+		_, response.JsonResponse = newErrorResponse(newMaintenanceError())
+		return response
+	}
+	if isStarting() {
+		_, response.JsonResponse = newErrorResponse(newStartingError())
+		return response
+	}
+
+	ctx, span := tracer.Start(r.Context(), "processWsMessage")
+
+	started := time.Now()
+	task, rawResponse, meta, err := processTask(ctx, message)
+	encoded := rawResponse
+	if err == nil {
+		encoded, err = encodeResult(rawResponse, false)
+	}
+	writeAuditEntry(task, ip, rawResponse, started, err)
+	recordTaskMetrics(task, started, err)
+	endSpan(span, err)
+
+	response.Id = task.Id
+	if err != nil {
+		_, response.JsonResponse = newErrorResponse(err)
+		return response
+	}
+
+	response.JsonResponse = JsonResponse{
+		Type: "success",
+		Body: encoded,
+		Meta: meta,
+	}
+
+	return response
+}